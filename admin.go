@@ -0,0 +1,146 @@
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+)
+
+// maskMatch compares s against a hostmask style pattern where * matches any sequence
+// of characters and ? matches a single character, ignoring case
+func maskMatch(mask string, s string) bool {
+	mask = strings.ToLower(mask)
+	s = strings.ToLower(s)
+
+	// Position to return to in each string if a later part of the pattern fails
+	// to match following a *
+	mi, si := 0, 0
+	starmi, starsi := -1, 0
+	for si < len(s) {
+		if mi < len(mask) && (mask[mi] == '?' || mask[mi] == s[si]) {
+			mi++
+			si++
+		} else if mi < len(mask) && mask[mi] == '*' {
+			starmi = mi
+			starsi = si
+			mi++
+		} else if starmi != -1 {
+			mi = starmi + 1
+			starsi++
+			si = starsi
+		} else {
+			return false
+		}
+	}
+	for mi < len(mask) && mask[mi] == '*' {
+		mi++
+	}
+	return mi == len(mask)
+}
+
+func isAdmin(src sourceDescriptor) bool {
+	if src.isServer {
+		return false
+	}
+	for _, x := range config.Admins {
+		if maskMatch(x, src.mask()) {
+			return true
+		}
+	}
+	return false
+}
+
+// irc_reply_target returns where a response to a message should be sent, the channel
+// if the message was sent to one otherwise the nick of the sender
+func irc_reply_target(src sourceDescriptor, args []string) string {
+	if strings.HasPrefix(args[2], "#") {
+		return args[2]
+	}
+	return src.nick
+}
+
+// irc_admin_command handles commands built into the bot that are restricted to
+// admins, returning true if the command was consumed
+func irc_admin_command(src sourceDescriptor, cmd string, args []string) bool {
+	switch cmd {
+	case "&reload":
+	default:
+		return false
+	}
+
+	if !isAdmin(src) {
+		irclog.Warnf("ignoring %v from non-admin %v", cmd, src.mask())
+		return true
+	}
+
+	irclog.Printf("processing admin command %v from %v", cmd, src.mask())
+
+	switch cmd {
+	case "&reload":
+		err := irc_reload()
+		if err != nil {
+			irclog.Errorf("configuration reload failed: %v", err)
+			runtime.out.reply(src, args, fmt.Sprintf("reload failed: %v", err))
+			return true
+		}
+		runtime.out.reply(src, args, "reload complete")
+	}
+
+	return true
+}
+
+// irc_reload rereads the configuration file and applies it to the running bot. The
+// new configuration and modules are fully prepared before anything is replaced, so
+// if an error is returned the running state is left untouched.
+func irc_reload() error {
+	irclog.Print("reloading configuration")
+
+	newcfg, err := loadCfg(configPath)
+	if err != nil {
+		return err
+	}
+	mods, err := buildModules(newcfg)
+	if err != nil {
+		return err
+	}
+	// Logging is applied last of all, nothing may fail once it has changed
+	err = logConfigure(newcfg.Log)
+	if err != nil {
+		return err
+	}
+
+	// Settings tied to the connection itself are only picked up when we next
+	// connect; the nick is kept since isMe relies on it matching the current
+	// connection
+	if newcfg.Nick != config.Nick {
+		irclog.Warnf("nick change to %v requires a restart, keeping %v",
+			newcfg.Nick, config.Nick)
+		newcfg.Nick = config.Nick
+	}
+	if strings.Join(newcfg.Servers, " ") != strings.Join(config.Servers, " ") ||
+		newcfg.VerifyCert != config.VerifyCert ||
+		!reflect.DeepEqual(newcfg.TLS, config.TLS) ||
+		newcfg.Connection != config.Connection ||
+		newcfg.SaslUser != config.SaslUser ||
+		newcfg.SaslPassword != config.SaslPassword ||
+		newcfg.ServerPassword != config.ServerPassword {
+		irclog.Print("connection settings changed, they will apply on the next connection")
+	}
+
+	configLock.Lock()
+	config = newcfg
+	configLock.Unlock()
+	runtime.reconfigureChannels(newcfg.Channels)
+
+	if !runtime.shutdownModules() {
+		irclog.Warnf("some modules failed to shut down cleanly during reload")
+	}
+	runtime.modules = nil
+	runtime.moduleGen++
+	for _, m := range mods {
+		runtime.addModule(m)
+	}
+
+	irclog.Print("configuration reload complete")
+	return nil
+}
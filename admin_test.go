@@ -0,0 +1,120 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"testing"
+)
+
+func TestReloadFailure(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kraz")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	defer logConfigure(logCfg{})
+	oldPath := configPath
+	defer func() { configPath = oldPath }()
+	configPath = path.Join(dir, "kraz.yaml")
+
+	if err := logConfigure(logCfg{Level: "warn"}); err != nil {
+		t.Fatal(err)
+	}
+	for _, x := range []string{
+		// Rejected when the configuration is loaded
+		"interval: 5",
+		// Only fails once the modules are built
+		"interval: 5m\n  calendar: " + path.Join(dir, "missing.yaml"),
+	} {
+		buf := "nick: kraz\nservers: [irc.example.com:6697]\nlog:\n  level: debug\n" +
+			"ticker:\n  channel: \"#test\"\n  symbols: [AAPL]\n  " + x + "\n"
+		if err := ioutil.WriteFile(configPath, []byte(buf), 0600); err != nil {
+			t.Fatal(err)
+		}
+		if err := irc_reload(); err == nil {
+			t.Fatalf("%q: reload succeeded", x)
+		}
+		logs.Lock()
+		level := logs.level
+		logs.Unlock()
+		if level != LOG_WARN {
+			t.Fatalf("%q: log level changed to %v by a failed reload", x, level)
+		}
+	}
+}
+
+func TestReload(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kraz")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	defer logConfigure(logCfg{})
+	oldPath := configPath
+	defer func() { configPath = oldPath }()
+	configPath = path.Join(dir, "kraz.yaml")
+	defer func() {
+		runtime.shutdownModules()
+		runtime = kruntime{}
+	}()
+
+	config = &cfg{Nick: "kraz", Channels: []string{"#a", "#b"}, Ticker: tickerCfg{
+		Interval: "5m", Channel: "#a", Symbols: []string{"AAPL"}}}
+	oc := &outputCapture{}
+	runtime = *newCaptureRuntime(oc)
+	runtime.ircout = make(chan []byte, 16)
+	runtime.channel = []channelStatus{{name: "#a", joined: true},
+		{name: "#b", joined: true}}
+	if err := moduleRegistration(); err != nil {
+		t.Fatal(err)
+	}
+	old := runtime.modules[0]
+
+	// A fetch started by a module the reload replaces has its result dropped
+	release := make(chan bool)
+	runtime.background(func() func() {
+		<-release
+		return func() { runtime.out.privmsg("#b", "stale") }
+	})
+
+	buf := "nick: kraz\nservers: [irc.example.com:6697]\nchannels: [\"#b\", \"#c\"]\n" +
+		"ticker:\n  interval: 5m\n  channel: \"#b\"\n  symbols: [AAPL]\n" +
+		"chanlog:\n  datapath: " + dir + "\n"
+	if err := ioutil.WriteFile(configPath, []byte(buf), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := irc_reload(); err != nil {
+		t.Fatal(err)
+	}
+	close(release)
+	runFetches(t, &runtime)
+
+	if len(oc.calls) != 1 || oc.calls[0] != (outputCall{"part", "#a", ""}) {
+		t.Fatalf("unexpected calls %v", oc.calls)
+	}
+	var names []string
+	for _, x := range runtime.channel {
+		names = append(names, fmt.Sprintf("%v %v", x.name, x.joined))
+	}
+	if strings.Join(names, ",") != "#b true,#c false" {
+		t.Fatalf("unexpected channels %v", names)
+	}
+	irc_periodic()
+	if got := outputLines(&runtime); len(got) != 1 || got[0] != "JOIN #c" {
+		t.Fatalf("unexpected output %q", got)
+	}
+
+	if runtime.modules[0] == old {
+		t.Fatal("ticker module was not reinstantiated")
+	}
+	if tk := runtime.modules[0].(*ticker); tk.channel != "#b" {
+		t.Fatalf("ticker channel %v after reload", tk.channel)
+	}
+	last := runtime.modules[len(runtime.modules)-1]
+	if last.getName() != "chanlog" {
+		t.Fatalf("chanlog module not added, last module is %v", last.getName())
+	}
+}
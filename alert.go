@@ -0,0 +1,403 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var alertlog = newLogger("module:alert")
+
+// alertEntry is a price alert set by a user. Level alerts fire when the price crosses
+// above (>) or below (<) level, move alerts when the change since the previous close
+// is at least level percent in either direction.
+type alertEntry struct {
+	id     int
+	owner  string // Who set the alert, as given by portfolioKey
+	nick   string // Nick of the owner, the alert is delivered as a highlight to them
+	target string // Channel the alert was set in, or the nick if it was set privately
+	symbol string
+	op     string // >, < or move
+	level  float64
+	armed  bool // Cleared when the alert fires, set again once the price moves back
+}
+
+// alertState is the persisted form of an alertEntry
+type alertState struct {
+	ID     int
+	Owner  string
+	Nick   string
+	Target string
+	Symbol string
+	Op     string
+	Level  float64
+	Armed  bool
+}
+
+type alertTableState struct {
+	NextID int
+	Alerts []alertState
+}
+
+// Alerts by ID, kept outside the module so they survive a configuration reload
+var alertTable map[int]*alertEntry
+var alertNextID int
+
+type alert struct {
+	providers  []quoteProvider
+	workers    int
+	interval   time.Duration
+	hysteresis float64 // Percentage the price must move back by to rearm an alert
+	max        int     // Alerts each user may have
+
+	lastRun time.Time
+}
+
+// met returns true if the alert condition holds for q
+func (e *alertEntry) met(q quote) bool {
+	switch e.op {
+	case ">":
+		return q.price > e.level
+	case "<":
+		return q.price < e.level
+	}
+	return math.Abs(q.percent) >= e.level
+}
+
+// rearmed returns true once q has moved back from the alert level by at least
+// hysteresis percent
+func (e *alertEntry) rearmed(q quote, hysteresis float64) bool {
+	switch e.op {
+	case ">":
+		return q.price < e.level*(1-hysteresis/100)
+	case "<":
+		return q.price > e.level*(1+hysteresis/100)
+	}
+	return math.Abs(q.percent) < e.level*(1-hysteresis/100)
+}
+
+// String returns the alert as it would be given to &alert
+func (e *alertEntry) String() string {
+	level := strconv.FormatFloat(e.level, 'f', -1, 64)
+	if e.op == "move" {
+		return fmt.Sprintf("#%v %v move %v%%", e.id, e.symbol, level)
+	}
+	return fmt.Sprintf("#%v %v %v %v", e.id, e.symbol, e.op, level)
+}
+
+// current returns the part of q the alert is concerned with
+func (e *alertEntry) current(q quote) string {
+	if e.op == "move" {
+		return quoteFormatChange(q)
+	}
+	return quoteFormatPrice(q.price)
+}
+
+// message returns the text sent when the alert fires
+func (e *alertEntry) message(q quote) string {
+	var text string
+	switch e.op {
+	case ">":
+		text = fmt.Sprintf("%v %v is above %v", e.symbol, quoteFormatPrice(q.price),
+			strconv.FormatFloat(e.level, 'f', -1, 64))
+	case "<":
+		text = fmt.Sprintf("%v %v is below %v", e.symbol, quoteFormatPrice(q.price),
+			strconv.FormatFloat(e.level, 'f', -1, 64))
+	default:
+		text = fmt.Sprintf("%v %v %v has moved %v%% or more", e.symbol,
+			quoteFormatPrice(q.price), quoteFormatChange(q),
+			strconv.FormatFloat(e.level, 'f', -1, 64))
+	}
+	text = "[alert] " + text
+	if strings.HasPrefix(e.target, "#") {
+		return e.nick + ": " + text
+	}
+	return text
+}
+
+// alertIDs returns the IDs of the alerts in the order they were set
+func alertIDs() []int {
+	var ret []int
+	for k := range alertTable {
+		ret = append(ret, k)
+	}
+	sort.Ints(ret)
+	return ret
+}
+
+func (a *alert) initialize() {
+	alertlog.Print("alert initializing")
+	a.lastRun = clockNow()
+	if alertTable != nil {
+		return
+	}
+	alertTable = make(map[int]*alertEntry)
+
+	var saved alertTableState
+	err := stateLoad(a.getName(), &saved)
+	if err != nil {
+		alertlog.Errorf("alert error loading state: %v", err)
+		return
+	}
+	alertNextID = saved.NextID
+	for _, x := range saved.Alerts {
+		e := &alertEntry{
+			id:     x.ID,
+			owner:  x.Owner,
+			nick:   x.Nick,
+			target: x.Target,
+			symbol: x.Symbol,
+			op:     x.Op,
+			level:  x.Level,
+			armed:  x.Armed,
+		}
+		// Alerts saved before they had an owner belong to the nick that set them
+		if e.owner == "" {
+			e.owner = strings.ToLower(e.nick)
+		}
+		alertTable[x.ID] = e
+	}
+	if len(saved.Alerts) > 0 {
+		alertlog.Printf("alert restored %v alerts", len(saved.Alerts))
+	}
+}
+
+func (a *alert) save() error {
+	saved := alertTableState{NextID: alertNextID}
+	for _, id := range alertIDs() {
+		e := alertTable[id]
+		saved.Alerts = append(saved.Alerts, alertState{
+			ID:     e.id,
+			Owner:  e.owner,
+			Nick:   e.nick,
+			Target: e.target,
+			Symbol: e.symbol,
+			Op:     e.op,
+			Level:  e.level,
+			Armed:  e.armed,
+		})
+	}
+	return stateSave(a.getName(), saved)
+}
+
+func (a *alert) shutdown() error {
+	return a.save()
+}
+
+func (a *alert) getName() string {
+	return "alert"
+}
+
+func (a *alert) shouldRun() bool {
+	return len(alertTable) > 0 && clockNow().After(a.lastRun.Add(a.interval))
+}
+
+func (a *alert) shouldRunOnJoin(channel string) bool {
+	return false
+}
+
+func (a *alert) execute(r *kruntime) error {
+	a.lastRun = clockNow()
+	alertlog.Debugf("alert module executing")
+
+	var symbols []string
+	seen := make(map[string]bool)
+	for _, id := range alertIDs() {
+		if s := alertTable[id].symbol; !seen[s] {
+			seen[s] = true
+			symbols = append(symbols, s)
+		}
+	}
+	quoteRequest(r, a.providers, a.workers, 0, symbols, func(quotes map[string]quote) {
+		a.check(r, quotes)
+	})
+	return nil
+}
+
+// check fires and rearms alerts against freshly fetched quotes
+func (a *alert) check(r *kruntime, quotes map[string]quote) {
+	changed := false
+	// Alerts may have been added or removed while the quotes were fetched
+	for _, id := range alertIDs() {
+		e := alertTable[id]
+		q, ok := quotes[e.symbol]
+		if !ok {
+			continue
+		}
+		if e.armed && e.met(q) {
+			alertlog.Printf("alert %v fired for %v", e, e.nick)
+			e.armed = false
+			changed = true
+			r.out.privmsg(e.target, e.message(q))
+		} else if !e.armed && e.rearmed(q, a.hysteresis) {
+			alertlog.Debugf("alert %v rearmed", e)
+			e.armed = true
+			changed = true
+		}
+	}
+	if changed {
+		if err := a.save(); err != nil {
+			alertlog.Errorf("alert error saving state: %v", err)
+		}
+	}
+}
+
+func (a *alert) handlesCommand(cmd string) bool {
+	return cmd == "&alert" || cmd == "&alerts" || cmd == "&unalert"
+}
+
+func (a *alert) handlesQuery(cmd string) bool {
+	return a.handlesCommand(cmd)
+}
+
+func (a *alert) handleCommand(src sourceDescriptor, cmd string, args []string, r *kruntime) {
+	switch cmd {
+	case "&alert":
+		a.add(src, args, r)
+	case "&alerts":
+		var list []string
+		for _, id := range alertIDs() {
+			if e := alertTable[id]; e.owner == portfolioKey(src) {
+				list = append(list, e.String())
+			}
+		}
+		if len(list) == 0 {
+			r.out.reply(src, args, "[alert] you have no alerts")
+			return
+		}
+		r.out.reply(src, args, "[alert] "+strings.Join(list, ", "))
+	case "&unalert":
+		params := irc_params(args)
+		if len(params) < 1 {
+			r.out.reply(src, args, "[alert] usage: &unalert <id|all>")
+			return
+		}
+		removed := 0
+		want, err := strconv.Atoi(strings.TrimPrefix(params[0], "#"))
+		for _, id := range alertIDs() {
+			e := alertTable[id]
+			if e.owner != portfolioKey(src) {
+				continue
+			}
+			if params[0] == "all" || (err == nil && id == want) {
+				delete(alertTable, id)
+				removed++
+			}
+		}
+		if removed == 0 {
+			r.out.reply(src, args, fmt.Sprintf("[alert] you have no alert %v", params[0]))
+			return
+		}
+		r.out.reply(src, args, fmt.Sprintf("[alert] removed %v", humanizeCount(removed,
+			"alert")))
+		if err := a.save(); err != nil {
+			alertlog.Errorf("alert error saving state: %v", err)
+		}
+	}
+}
+
+// add handles &alert <symbol> > <price>, &alert <symbol> < <price> and
+// &alert <symbol> move <percent>%
+func (a *alert) add(src sourceDescriptor, args []string, r *kruntime) {
+	params := irc_params(args)
+	if len(params) < 3 {
+		r.out.reply(src, args, "[alert] usage: &alert <symbol> > <price>, "+
+			"&alert <symbol> < <price> or &alert <symbol> move <percent>%")
+		return
+	}
+	symbol := strings.ToUpper(params[0])
+	if strings.ContainsAny(symbol, " /?#&") {
+		r.out.reply(src, args, fmt.Sprintf("[alert] %q is not a valid symbol", params[0]))
+		return
+	}
+	op := strings.ToLower(params[1])
+	val := strings.Replace(params[2], ",", "", -1)
+	switch op {
+	case ">", "<":
+	case "move":
+		val = strings.TrimSuffix(val, "%")
+	default:
+		r.out.reply(src, args, fmt.Sprintf("[alert] unknown condition %q, use >, < or move",
+			params[1]))
+		return
+	}
+	level, err := strconv.ParseFloat(val, 64)
+	if err != nil || level <= 0 || math.IsInf(level, 0) {
+		r.out.reply(src, args, fmt.Sprintf("[alert] %q is not a valid level", params[2]))
+		return
+	}
+
+	if a.full(src, args, r) {
+		return
+	}
+
+	// Checking the symbol now reports a mistyped symbol straight away rather than the
+	// alert never firing
+	quoteRequest(r, a.providers, a.workers, 0, []string{symbol},
+		func(found map[string]quote) {
+			q, ok := found[symbol]
+			if !ok {
+				r.out.reply(src, args, fmt.Sprintf("[alert] no quote found for %v", symbol))
+				return
+			}
+			// Checked again as other alerts may have been set during the fetch
+			if !a.full(src, args, r) {
+				a.create(src, args, r, symbol, op, level, q)
+			}
+		})
+}
+
+// full replies and returns true if src already has as many alerts as allowed
+func (a *alert) full(src sourceDescriptor, args []string, r *kruntime) bool {
+	count := 0
+	for _, e := range alertTable {
+		if e.owner == portfolioKey(src) {
+			count++
+		}
+	}
+	if count >= a.max {
+		r.out.reply(src, args, fmt.Sprintf("[alert] you already have %v, remove one "+
+			"with &unalert first", humanizeCount(count, "alert")))
+		return true
+	}
+	return false
+}
+
+// create adds an alert, q is the current quote for symbol
+func (a *alert) create(src sourceDescriptor, args []string, r *kruntime, symbol string,
+	op string, level float64, q quote) {
+	alertNextID++
+	e := &alertEntry{
+		id:     alertNextID,
+		owner:  portfolioKey(src),
+		nick:   src.nick,
+		target: irc_reply_target(src, args),
+		symbol: symbol,
+		op:     op,
+		level:  level,
+	}
+	// An alert whose condition already holds waits for the price to move back first,
+	// rather than firing on the next check
+	e.armed = !e.met(q)
+	alertTable[e.id] = e
+
+	msg := fmt.Sprintf("[alert] set %v, now %v", e, e.current(q))
+	if !e.armed {
+		msg += ", already reached so it fires after moving back"
+	}
+	r.out.reply(src, args, msg)
+	if err := a.save(); err != nil {
+		alertlog.Errorf("alert error saving state: %v", err)
+	}
+}
+
+// humanizeCount returns n with noun, pluralized if needed
+func humanizeCount(n int, noun string) string {
+	if n == 1 {
+		return fmt.Sprintf("%v %v", n, noun)
+	}
+	return fmt.Sprintf("%v %vs", n, noun)
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestAlerts(t *testing.T) {
+	m := newModuleTest(t)
+	alertTable = nil
+	alertNextID = 0
+	defer func() { alertTable = nil }()
+
+	setPrice := func(price float64, percent float64) {
+		m.quotes(`{"AAPL": {"Price": %v, "Change": 1, "Percent": %v}}`, price, percent)
+	}
+	setPrice(195, 1)
+
+	oc, r := m.oc, m.r
+	a := &alert{providers: m.providers, workers: 1, hysteresis: 1, max: 2}
+	a.initialize()
+
+	alice := sourceDescriptor{nick: "alice"}
+	command := func(src sourceDescriptor, target string, line string) string {
+		return m.reply(a, src, target, line)
+	}
+	check := func(want ...outputCall) {
+		oc.calls = nil
+		if err := a.execute(r); err != nil {
+			t.Fatal(err)
+		}
+		runFetches(t, r)
+		if fmt.Sprint(oc.calls) != fmt.Sprint(want) {
+			t.Fatalf("unexpected alerts %v, wanted %v", oc.calls, want)
+		}
+	}
+
+	if got := command(alice, "#test", "&alert  aapl  > 200"); got !=
+		"[alert] set #1 AAPL > 200, now 195.00" {
+		t.Fatalf("unexpected reply %q", got)
+	}
+	if got := command(alice, "kraz", "&alert AAPL move 5%"); got !=
+		"[alert] set #2 AAPL move 5%, now +1.00 (+1.00%)" {
+		t.Fatalf("unexpected reply %q", got)
+	}
+	if got := command(alice, "#test", "&alert MSFT > 1"); got !=
+		"[alert] you already have 2 alerts, remove one with &unalert first" {
+		t.Fatalf("unexpected reply %q", got)
+	}
+	check()
+
+	// Crossing the level fires once, and not again until the price has moved back by
+	// the hysteresis
+	setPrice(201, 6)
+	check(outputCall{"privmsg", "#test", "alice: [alert] AAPL 201.00 is above 200"},
+		outputCall{"privmsg", "alice", "[alert] AAPL 201.00 +1.00 (+6.00%) has moved 5% or more"})
+	check()
+	setPrice(199, 4.96)
+	check()
+	setPrice(201, 6)
+	check()
+	setPrice(197, 4)
+	check()
+	setPrice(201, 6)
+	check(outputCall{"privmsg", "#test", "alice: [alert] AAPL 201.00 is above 200"},
+		outputCall{"privmsg", "alice", "[alert] AAPL 201.00 +1.00 (+6.00%) has moved 5% or more"})
+
+	// Alerts are persisted, including whether they have fired
+	if err := a.shutdown(); err != nil {
+		t.Fatal(err)
+	}
+	alertTable = nil
+	a.initialize()
+	check()
+	if got := command(alice, "#test", "&alerts"); got !=
+		"[alert] #1 AAPL > 200, #2 AAPL move 5%" {
+		t.Fatalf("unexpected reply %q", got)
+	}
+
+	// Alerts belong to the services account if logged in, not whoever has the nick
+	mallory := sourceDescriptor{nick: "alice", account: "mallory"}
+	if got := command(mallory, "#test", "&alerts"); got != "[alert] you have no alerts" {
+		t.Fatalf("unexpected reply %q", got)
+	}
+
+	// Only the owner can remove an alert
+	if got := command(sourceDescriptor{nick: "bob"}, "#test", "&unalert 1"); got !=
+		"[alert] you have no alert 1" {
+		t.Fatalf("unexpected reply %q", got)
+	}
+	if got := command(alice, "#test", "&unalert  #1"); got != "[alert] removed 1 alert" {
+		t.Fatalf("unexpected reply %q", got)
+	}
+	if got := command(alice, "#test", "&alert TSLA > 100"); got !=
+		"[alert] no quote found for TSLA" {
+		t.Fatalf("unexpected reply %q", got)
+	}
+}
@@ -0,0 +1,310 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// calcNode is a node in a parsed &calc expression
+type calcNode interface {
+	eval(symbols map[string]float64) (float64, error)
+}
+
+type calcNumber float64
+
+type calcSymbol string
+
+type calcUnary struct {
+	op      byte
+	operand calcNode
+}
+
+type calcBinary struct {
+	op          byte
+	left, right calcNode
+}
+
+func (n calcNumber) eval(symbols map[string]float64) (float64, error) {
+	return float64(n), nil
+}
+
+func (n calcSymbol) eval(symbols map[string]float64) (float64, error) {
+	v, ok := symbols[string(n)]
+	if !ok {
+		return 0, fmt.Errorf("unknown symbol %v", string(n))
+	}
+	return v, nil
+}
+
+func (n calcUnary) eval(symbols map[string]float64) (float64, error) {
+	v, err := n.operand.eval(symbols)
+	if n.op == '-' {
+		v = -v
+	}
+	return v, err
+}
+
+func (n calcBinary) eval(symbols map[string]float64) (float64, error) {
+	l, err := n.left.eval(symbols)
+	if err != nil {
+		return 0, err
+	}
+	r, err := n.right.eval(symbols)
+	if err != nil {
+		return 0, err
+	}
+	var ret float64
+	switch n.op {
+	case '+':
+		ret = l + r
+	case '-':
+		ret = l - r
+	case '*':
+		ret = l * r
+	case '/':
+		if r == 0 {
+			return 0, fmt.Errorf("division by zero")
+		}
+		ret = l / r
+	case '^':
+		ret = math.Pow(l, r)
+	}
+	if math.IsInf(ret, 0) || math.IsNaN(ret) {
+		return 0, fmt.Errorf("result out of range")
+	}
+	return ret, nil
+}
+
+// Multipliers for unit suffixes on numbers
+var calcUnits = map[byte]float64{'k': 1e3, 'm': 1e6, 'b': 1e9}
+
+// calcParser is a recursive descent parser for &calc expressions:
+//
+//	expr    = term { ("+" | "-") term }
+//	term    = unary { ("*" | "/") unary }
+//	unary   = ("+" | "-") unary | power
+//	power   = primary [ "^" unary ]
+//	primary = number [ "k" | "m" | "b" ] [ "%" ] | symbol | "(" expr ")"
+//
+// Symbols start with a letter, or $ for symbols containing a - such as $BTC-USD.
+type calcParser struct {
+	s       string
+	pos     int
+	symbols []string // Symbols referenced, in the order they first appear
+}
+
+// calcParse parses s, returning the expression and the symbols it refers to
+func calcParse(s string) (calcNode, []string, error) {
+	p := &calcParser{s: s}
+	n, err := p.expr()
+	if err != nil {
+		return nil, nil, err
+	}
+	p.space()
+	if p.pos < len(p.s) {
+		return nil, nil, p.errorf("unexpected %q", p.s[p.pos])
+	}
+	return n, p.symbols, nil
+}
+
+// calcCount parses a plain number such as 1,500 or 1.5k, with the unit suffixes
+// accepted in expressions
+func calcCount(s string) (float64, error) {
+	p := &calcParser{s: s}
+	if s == "" || !isCalcDigit(s[0]) && s[0] != '.' {
+		return 0, fmt.Errorf("invalid number %q", s)
+	}
+	n, err := p.number()
+	if err != nil {
+		return 0, err
+	}
+	if p.pos < len(p.s) || strings.HasSuffix(s, "%") {
+		return 0, fmt.Errorf("invalid number %q", s)
+	}
+	return float64(n.(calcNumber)), nil
+}
+
+func (p *calcParser) errorf(format string, a ...interface{}) error {
+	return fmt.Errorf("%v at position %v", fmt.Sprintf(format, a...), p.pos+1)
+}
+
+func (p *calcParser) space() {
+	for p.pos < len(p.s) && p.s[p.pos] == ' ' {
+		p.pos++
+	}
+}
+
+// next returns the next character without consuming it, 0 at the end
+func (p *calcParser) next() byte {
+	p.space()
+	if p.pos == len(p.s) {
+		return 0
+	}
+	return p.s[p.pos]
+}
+
+func (p *calcParser) expr() (calcNode, error) {
+	n, err := p.term()
+	if err != nil {
+		return nil, err
+	}
+	for c := p.next(); c == '+' || c == '-'; c = p.next() {
+		p.pos++
+		r, err := p.term()
+		if err != nil {
+			return nil, err
+		}
+		n = calcBinary{op: c, left: n, right: r}
+	}
+	return n, nil
+}
+
+func (p *calcParser) term() (calcNode, error) {
+	n, err := p.unary()
+	if err != nil {
+		return nil, err
+	}
+	for c := p.next(); c == '*' || c == '/'; c = p.next() {
+		p.pos++
+		r, err := p.unary()
+		if err != nil {
+			return nil, err
+		}
+		n = calcBinary{op: c, left: n, right: r}
+	}
+	return n, nil
+}
+
+func (p *calcParser) unary() (calcNode, error) {
+	if c := p.next(); c == '+' || c == '-' {
+		p.pos++
+		n, err := p.unary()
+		if err != nil {
+			return nil, err
+		}
+		return calcUnary{op: c, operand: n}, nil
+	}
+	n, err := p.primary()
+	if err != nil {
+		return nil, err
+	}
+	if p.next() == '^' {
+		p.pos++
+		// Right associative, and binds tighter than a unary minus on its left so
+		// -2^2 is -4
+		r, err := p.unary()
+		if err != nil {
+			return nil, err
+		}
+		n = calcBinary{op: '^', left: n, right: r}
+	}
+	return n, nil
+}
+
+func isCalcLetter(c byte) bool {
+	return (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z')
+}
+
+func isCalcDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
+
+func (p *calcParser) primary() (calcNode, error) {
+	c := p.next()
+	switch {
+	case c == 0:
+		return nil, p.errorf("unexpected end of expression")
+	case c == '(':
+		p.pos++
+		n, err := p.expr()
+		if err != nil {
+			return nil, err
+		}
+		if p.next() != ')' {
+			return nil, p.errorf("missing )")
+		}
+		p.pos++
+		return n, nil
+	case isCalcDigit(c) || c == '.':
+		return p.number()
+	case isCalcLetter(c) || c == '$':
+		return p.symbol()
+	}
+	return nil, p.errorf("unexpected %q", c)
+}
+
+func (p *calcParser) number() (calcNode, error) {
+	start := p.pos
+	var b strings.Builder
+	for p.pos < len(p.s) {
+		c := p.s[p.pos]
+		// Commas are accepted as thousands separators
+		if c == ',' && p.pos+1 < len(p.s) && isCalcDigit(p.s[p.pos+1]) {
+			p.pos++
+			continue
+		}
+		if !isCalcDigit(c) && c != '.' {
+			break
+		}
+		b.WriteByte(c)
+		p.pos++
+	}
+	v, err := strconv.ParseFloat(b.String(), 64)
+	if err != nil {
+		p.pos = start
+		return nil, p.errorf("invalid number %q", b.String())
+	}
+	if p.pos < len(p.s) {
+		if m, ok := calcUnits[p.s[p.pos]|0x20]; ok && isCalcLetter(p.s[p.pos]) &&
+			(p.pos+1 == len(p.s) || !isCalcLetter(p.s[p.pos+1])) {
+			v *= m
+			p.pos++
+		}
+	}
+	if p.pos < len(p.s) && p.s[p.pos] == '%' {
+		v /= 100
+		p.pos++
+	}
+	return calcNumber(v), nil
+}
+
+func (p *calcParser) symbol() (calcNode, error) {
+	dollar := p.s[p.pos] == '$'
+	if dollar {
+		p.pos++
+	}
+	start := p.pos
+	for p.pos < len(p.s) {
+		c := p.s[p.pos]
+		if !isCalcLetter(c) && !isCalcDigit(c) && c != '.' && c != '=' &&
+			!(dollar && c == '-') {
+			break
+		}
+		p.pos++
+	}
+	if p.pos == start {
+		return nil, p.errorf("missing symbol after $")
+	}
+	sym := strings.ToUpper(p.s[start:p.pos])
+	if !containsFold(p.symbols, sym) {
+		p.symbols = append(p.symbols, sym)
+	}
+	return calcSymbol(sym), nil
+}
+
+// calcFormat formats a result with thousands separators and up to four decimal places
+func calcFormat(v float64) string {
+	s := strconv.FormatFloat(math.Abs(v), 'f', 4, 64)
+	s = strings.TrimRight(strings.TrimRight(s, "0"), ".")
+	parts := strings.SplitN(s, ".", 2)
+	for i := len(parts[0]) - 3; i > 0; i -= 3 {
+		parts[0] = parts[0][:i] + "," + parts[0][i:]
+	}
+	s = strings.Join(parts, ".")
+	if v < 0 && s != "0" {
+		return "-" + s
+	}
+	return s
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCalc(t *testing.T) {
+	symbols := map[string]float64{"AAPL": 120.5, "MSFT": 300, "BTC-USD": 20000}
+	for _, x := range []struct {
+		expr string
+		want string
+	}{
+		{"1 + 2 * 3", "7"},
+		{"(1 + 2) * 3", "9"},
+		{"2^3^2", "512"},
+		{"-2^2", "-4"},
+		{"10 / 4", "2.5"},
+		{"1/3", "0.3333"},
+		{"5k + 1.5M + 2b", "2,001,505,000"},
+		{"1,000 * 5%", "50"},
+		{"150*AAPL + 20*msft - 5k", "19,075"},
+		{"(AAPL/MSFT)", "0.4017"},
+		{"$btc-usd - 1", "19,999"},
+		{"1 / (MSFT - 300)", "division by zero"},
+		{"TSLA * 2", "unknown symbol TSLA"},
+		{"2 * (3 + 4", "missing ) at position 11"},
+		{"2 +", "unexpected end of expression at position 4"},
+		{"2 3", "unexpected '3' at position 3"},
+	} {
+		var got string
+		n, _, err := calcParse(x.expr)
+		if err == nil {
+			var v float64
+			v, err = n.eval(symbols)
+			got = calcFormat(v)
+		}
+		if err != nil {
+			got = err.Error()
+		}
+		if got != x.want {
+			t.Errorf("%q: got %q, wanted %q", x.expr, got, x.want)
+		}
+	}
+
+	_, syms, err := calcParse("AAPL + aapl * MSFT")
+	if err != nil || len(syms) != 2 || syms[0] != "AAPL" || syms[1] != "MSFT" {
+		t.Fatalf("unexpected symbols %v (%v)", syms, err)
+	}
+}
+
+func TestCalcCommand(t *testing.T) {
+	m := newModuleTest(t)
+	m.quotes(`{"AAPL": {"Price": 150}}`)
+	tk := &ticker{providers: m.providers, workers: 1, cacheTTL: time.Minute}
+	alice := sourceDescriptor{nick: "alice"}
+	for _, x := range []struct {
+		line string
+		want string
+	}{
+		{"&calc AAPL 5", "[calc] AAPL 5 x $150.0000 = $750.00"},
+		{"&calc  5", "[calc] 5 = 5"},
+		{"&calc 2 * aapl", "[calc] 2 * aapl = 300 (AAPL 150.00)"},
+		{"&calc  ", "[calc] unexpected end of expression at position 1"},
+		{"&calc A+B+C+D+E+F+G+H+I+J+K", "[calc] at most 10 symbols can be used at once"},
+	} {
+		if got := m.reply(tk, alice, "#test", x.line); got != x.want {
+			t.Errorf("%q: unexpected reply %q, wanted %q", x.line, got, x.want)
+		}
+	}
+}
@@ -0,0 +1,246 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"sort"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v2"
+)
+
+// exchangeCfg describes an exchange in the calendar data file. Times are local to the
+// exchange, in 24 hour HH:MM format.
+type exchangeCfg struct {
+	Timezone  string
+	Open      string
+	Close     string
+	PreOpen   string            // Start of pre-market trading, none if unset
+	PostClose string            // End of post-market trading, none if unset
+	Weekends  bool              // Trades on Saturday and Sunday
+	Suffixes  []string          // Symbol suffixes used for the exchange, such as .L
+	Holidays  []string          // Dates the exchange is closed, YYYY-MM-DD
+	HalfDays  map[string]string // Dates the exchange closes early, to the closing time
+}
+
+// calendarFile is the format of the calendar data file
+type calendarFile struct {
+	Default   string // Exchange for symbols not matched otherwise
+	Exchanges map[string]exchangeCfg
+	Symbols   map[string]string // Exchange for particular symbols
+}
+
+// Market sessions returned by exchange.session
+const (
+	SESSION_CLOSED  = ""
+	SESSION_PRE     = "pre"
+	SESSION_REGULAR = "regular"
+	SESSION_POST    = "post"
+)
+
+// exchange is a trading calendar, times are in minutes after local midnight
+type exchange struct {
+	name      string
+	loc       *time.Location
+	open      int
+	close     int
+	preOpen   int
+	postClose int
+	weekends  bool
+	suffixes  []string
+	holidays  map[string]bool
+	halfDays  map[string]int
+}
+
+// calendar maps symbols to the exchange they trade on
+type calendar struct {
+	exchanges map[string]*exchange
+	def       *exchange
+	symbols   map[string]*exchange
+}
+
+// calendarMinutes parses a HH:MM time of day, 24:00 is accepted for the end of a day
+func calendarMinutes(s string) (int, error) {
+	var h, m int
+	_, err := fmt.Sscanf(s, "%d:%d", &h, &m)
+	if err != nil || len(s) != 5 || h < 0 || m < 0 || m > 59 || h*60+m > 24*60 {
+		return 0, fmt.Errorf("%q is not a valid time, use HH:MM", s)
+	}
+	return h*60 + m, nil
+}
+
+func newExchange(name string, c exchangeCfg) (*exchange, error) {
+	var err error
+	e := &exchange{name: name, weekends: c.Weekends, holidays: make(map[string]bool),
+		halfDays: make(map[string]int)}
+	if c.Timezone == "" {
+		return nil, fmt.Errorf("no timezone")
+	}
+	e.loc, err = time.LoadLocation(c.Timezone)
+	if err != nil {
+		return nil, err
+	}
+	e.open, err = calendarMinutes(c.Open)
+	if err != nil {
+		return nil, fmt.Errorf("open: %v", err)
+	}
+	e.close, err = calendarMinutes(c.Close)
+	if err != nil {
+		return nil, fmt.Errorf("close: %v", err)
+	}
+	if e.close <= e.open {
+		return nil, fmt.Errorf("close must be after open")
+	}
+	e.preOpen, e.postClose = e.open, e.close
+	if c.PreOpen != "" {
+		e.preOpen, err = calendarMinutes(c.PreOpen)
+		if err != nil || e.preOpen > e.open {
+			return nil, fmt.Errorf("preopen must be a time before open")
+		}
+	}
+	if c.PostClose != "" {
+		e.postClose, err = calendarMinutes(c.PostClose)
+		if err != nil || e.postClose < e.close {
+			return nil, fmt.Errorf("postclose must be a time after close")
+		}
+	}
+	for _, x := range c.Suffixes {
+		e.suffixes = append(e.suffixes, strings.ToUpper(x))
+	}
+	for _, x := range c.Holidays {
+		if _, err := time.Parse("2006-01-02", x); err != nil {
+			return nil, fmt.Errorf("holiday %q is not a valid date", x)
+		}
+		e.holidays[x] = true
+	}
+	for k, v := range c.HalfDays {
+		if _, err := time.Parse("2006-01-02", k); err != nil {
+			return nil, fmt.Errorf("half day %q is not a valid date", k)
+		}
+		e.halfDays[k], err = calendarMinutes(v)
+		if err != nil {
+			return nil, fmt.Errorf("half day %v: %v", k, err)
+		}
+	}
+	return e, nil
+}
+
+// loadCalendar reads exchange calendars from the data file at path
+func loadCalendar(path string) (*calendar, error) {
+	buf, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var f calendarFile
+	err = yaml.UnmarshalStrict(buf, &f)
+	if err != nil {
+		return nil, fmt.Errorf("%v: %v", path, err)
+	}
+
+	c := &calendar{exchanges: make(map[string]*exchange),
+		symbols: make(map[string]*exchange)}
+	for k, v := range f.Exchanges {
+		c.exchanges[strings.ToUpper(k)], err = newExchange(k, v)
+		if err != nil {
+			return nil, fmt.Errorf("%v: exchange %v: %v", path, k, err)
+		}
+	}
+	c.def = c.exchanges[strings.ToUpper(f.Default)]
+	if c.def == nil {
+		return nil, fmt.Errorf("%v: default exchange %q is not defined", path, f.Default)
+	}
+	for k, v := range f.Symbols {
+		e := c.exchanges[strings.ToUpper(v)]
+		if e == nil {
+			return nil, fmt.Errorf("%v: exchange %q for %v is not defined", path, v, k)
+		}
+		c.symbols[strings.ToUpper(k)] = e
+	}
+	return c, nil
+}
+
+// exchangeFor returns the exchange symbol trades on, from the symbols listed in the
+// data file, then the longest matching suffix, then the default exchange
+func (c *calendar) exchangeFor(symbol string) *exchange {
+	symbol = strings.ToUpper(symbol)
+	if e, ok := c.symbols[symbol]; ok {
+		return e
+	}
+	var names []string
+	for k := range c.exchanges {
+		names = append(names, k)
+	}
+	// Sorted so the result doesn't depend on map order if two exchanges share a suffix
+	sort.Strings(names)
+	var ret *exchange
+	best := 0
+	for _, k := range names {
+		for _, x := range c.exchanges[k].suffixes {
+			if len(x) > best && len(x) < len(symbol) && strings.HasSuffix(symbol, x) {
+				ret = c.exchanges[k]
+				best = len(x)
+			}
+		}
+	}
+	if ret != nil {
+		return ret
+	}
+	return c.def
+}
+
+// closeOn returns the closing time on local's date, ok is false if the exchange
+// doesn't trade that day
+func (e *exchange) closeOn(local time.Time) (close int, ok bool) {
+	date := local.Format("2006-01-02")
+	if e.holidays[date] {
+		return 0, false
+	}
+	if !e.weekends && (local.Weekday() == time.Saturday || local.Weekday() == time.Sunday) {
+		return 0, false
+	}
+	if v, ok := e.halfDays[date]; ok {
+		return v, true
+	}
+	return e.close, true
+}
+
+// session returns the trading session the exchange is in at tm
+func (e *exchange) session(tm time.Time) string {
+	local := tm.In(e.loc)
+	close, ok := e.closeOn(local)
+	if !ok {
+		return SESSION_CLOSED
+	}
+	m := local.Hour()*60 + local.Minute()
+	switch {
+	case m >= e.open && m < close:
+		return SESSION_REGULAR
+	case m >= e.preOpen && m < e.open:
+		return SESSION_PRE
+	case m >= close && m < e.postClose:
+		return SESSION_POST
+	}
+	return SESSION_CLOSED
+}
+
+// isOpen returns true if symbol is trading at tm, extended includes the pre and post
+// market sessions
+func (c *calendar) isOpen(symbol string, tm time.Time, extended bool) bool {
+	s := c.exchangeFor(symbol).session(tm)
+	return s == SESSION_REGULAR || (extended && s != SESSION_CLOSED)
+}
+
+// hours returns the regular session on the local day of tm, ok is false if the
+// exchange doesn't trade that day
+func (e *exchange) hours(tm time.Time) (open time.Time, close time.Time, ok bool) {
+	local := tm.In(e.loc)
+	end, ok := e.closeOn(local)
+	if !ok {
+		return open, close, false
+	}
+	midnight := time.Date(local.Year(), local.Month(), local.Day(), 0, 0, 0, 0, e.loc)
+	open = midnight.Add(time.Duration(e.open) * time.Minute)
+	close = midnight.Add(time.Duration(end) * time.Minute)
+	return open, close, true
+}
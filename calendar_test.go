@@ -0,0 +1,141 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCalendar(t *testing.T) {
+	c, err := loadCalendar("calendar.yaml.sample")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	at := func(s string) time.Time {
+		tm, err := time.Parse(time.RFC3339, s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return tm
+	}
+	for _, x := range []struct {
+		symbol string
+		time   string
+		want   string
+	}{
+		// New York is UTC-4 until November 1, then UTC-5
+		{"MSFT", "2026-10-19T13:30:00Z", SESSION_REGULAR},
+		{"MSFT", "2026-10-19T13:29:00Z", SESSION_PRE},
+		{"MSFT", "2026-11-02T13:30:00Z", SESSION_PRE},
+		{"MSFT", "2026-11-02T14:30:00Z", SESSION_REGULAR},
+		{"MSFT", "2026-11-02T21:00:00Z", SESSION_POST},
+		{"MSFT", "2026-11-03T01:00:00Z", SESSION_CLOSED},
+		{"MSFT", "2026-10-17T15:00:00Z", SESSION_CLOSED},
+		{"MSFT", "2026-11-26T15:00:00Z", SESSION_CLOSED},
+		{"MSFT", "2026-11-27T17:59:00Z", SESSION_REGULAR},
+		{"MSFT", "2026-11-27T18:00:00Z", SESSION_POST},
+		{"^gspc", "2026-10-19T15:00:00Z", SESSION_REGULAR},
+		{"VOD.L", "2026-10-19T07:00:00Z", SESSION_REGULAR},
+		{"VOD.L", "2026-10-19T15:30:00Z", SESSION_CLOSED},
+		{"RY.TO", "2026-10-12T15:00:00Z", SESSION_CLOSED},
+		{"BTC-USD", "2026-10-17T03:00:00Z", SESSION_REGULAR},
+	} {
+		e := c.exchangeFor(x.symbol)
+		if got := e.session(at(x.time)); got != x.want {
+			t.Errorf("%v at %v on %v: got %q, wanted %q", x.symbol, x.time, e.name, got,
+				x.want)
+		}
+	}
+
+	tk := &ticker{symbols: []string{"MSFT", "VOD.L", "BTC-USD"}, calendar: c,
+		interval: time.Minute}
+	got := tk.openSymbols(at("2026-10-19T14:00:00Z"))
+	if len(got) != 3 {
+		t.Fatalf("unexpected open symbols %v", got)
+	}
+	got = tk.openSymbols(at("2026-10-19T21:00:00Z"))
+	if len(got) != 1 || got[0] != "BTC-USD" {
+		t.Fatalf("unexpected open symbols %v", got)
+	}
+	tk.extended = true
+	got = tk.openSymbols(at("2026-10-19T21:00:00Z"))
+	if len(got) != 2 || got[0] != "MSFT" {
+		t.Fatalf("unexpected open symbols %v", got)
+	}
+}
+
+func TestTickerReports(t *testing.T) {
+	m := newModuleTest(t)
+	reportsPosted = nil
+	defer func() { reportsPosted = nil }()
+	now := time.Date(2026, 10, 19, 13, 35, 0, 0, time.UTC)
+	clockNow = func() time.Time { return now }
+	defer func() { clockNow = time.Now }()
+
+	m.quotes(`{
+		"^GSPC": {"Price": 6000, "Change": 30, "Percent": 0.5},
+		"AAPL": {"Price": 200, "Change": 4, "Percent": 2},
+		"MSFT": {"Price": 400, "Change": -8, "Percent": -2},
+		"IBM": {"Price": 250, "Change": 2.5, "Percent": 1}}`)
+	c, err := loadCalendar("calendar.yaml.sample")
+	if err != nil {
+		t.Fatal(err)
+	}
+	rc := tickerReportsCfg{Open: true, Close: true, Movers: 2, Indices: []string{"^gspc"},
+		OpenTemplate: "{{.Exchange}} open {{.Date}}"}
+	reports, err := newTickerReports(rc, c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	oc, r := m.oc, m.r
+	tk := &ticker{symbols: []string{"AAPL", "MSFT", "IBM"}, channel: "#stocks",
+		providers: m.providers, workers: 2,
+		calendar: c, reports: reports}
+	tk.initialize()
+
+	run := func(at time.Time, want ...string) {
+		now = at
+		oc.calls = nil
+		if tk.shouldRun() {
+			tk.execute(r)
+			runFetches(t, r)
+		}
+		var got []string
+		for _, x := range oc.calls {
+			got = append(got, x.text)
+		}
+		if strings.Join(got, "\n") != strings.Join(want, "\n") {
+			t.Fatalf("at %v got %q, wanted %q", at, got, want)
+		}
+	}
+
+	// Regular posts are disabled with an interval of zero
+	run(time.Date(2026, 10, 19, 13, 29, 0, 0, time.UTC))
+	run(time.Date(2026, 10, 19, 13, 35, 0, 0, time.UTC), "NYSE open 2026-10-19")
+	// A reload rebuilds the module, the report isn't posted again
+	tk.reports, err = newTickerReports(rc, c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	run(time.Date(2026, 10, 19, 13, 40, 0, 0, time.UTC))
+	// Nor after a restart
+	reportsPosted = nil
+	tk.initialize()
+	run(time.Date(2026, 10, 19, 13, 45, 0, 0, time.UTC))
+	run(time.Date(2026, 10, 19, 20, 1, 0, 0, time.UTC),
+		"[close] NYSE closed 2026-10-19 | ^GSPC 6000.00 +30.00 (+0.50%)",
+		"[close] AAPL 200.00 +4.00 (+2.00%) | MSFT 400.00 -8.00 (-2.00%) | "+
+			"IBM 250.00 +2.50 (+1.00%)",
+		"[close] gainers: AAPL 200.00 +4.00 (+2.00%), IBM 250.00 +2.50 (+1.00%)",
+		"[close] losers: MSFT 400.00 -8.00 (-2.00%)")
+	run(time.Date(2026, 10, 19, 20, 5, 0, 0, time.UTC))
+	// Reports missed by more than the window aren't posted late
+	run(time.Date(2026, 10, 20, 14, 30, 0, 0, time.UTC))
+	// No line is posted for the tracked symbols if none could be fetched
+	tk.symbols = []string{"FOO"}
+	run(time.Date(2026, 10, 20, 20, 1, 0, 0, time.UTC),
+		"[close] NYSE closed 2026-10-20 | ^GSPC 6000.00 +30.00 (+0.50%)")
+	// Nor on holidays
+	run(time.Date(2026, 11, 26, 14, 35, 0, 0, time.UTC))
+}
@@ -0,0 +1,259 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Messages stamped this long before registration completed are treated as playback,
+// allowing for a bouncer clock slightly behind our own
+var playbackSkew = 2 * time.Second
+
+// capState tracks IRCv3 capability negotiation and batches for a connection
+type capState struct {
+	available   map[string]string // Capabilities offered in CAP LS, with any values
+	enabled     map[string]bool   // Capabilities acknowledged by the server
+	negotiating bool              // CAP END has not been sent yet
+	saslPending bool              // Waiting for the result of SASL authentication
+	bindPending bool              // Waiting to bind to a bouncer network
+	batches     map[string]string // Open batches by reference, to their type
+}
+
+// irc_caps_wanted returns the capabilities we would like enabled, in the order they
+// are requested
+func irc_caps_wanted() []string {
+	ret := []string{"server-time", "batch", "labeled-response", "account-tag",
+		"znc.in/playback"}
+	if config.Bouncer.Network != "" {
+		// Only requested when binding, an unbound connection to soju with this
+		// capability only manages networks and never joins any channels
+		ret = append(ret, "soju.im/bouncer-networks")
+	}
+	if config.SaslUser != "" {
+		ret = append(ret, "sasl")
+	}
+	return ret
+}
+
+// irc_unescape_tag decodes a message tag value
+func irc_unescape_tag(s string) string {
+	if !strings.Contains(s, "\\") {
+		return s
+	}
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] != '\\' {
+			b.WriteByte(s[i])
+			continue
+		}
+		i++
+		if i == len(s) {
+			break
+		}
+		switch s[i] {
+		case ':':
+			b.WriteByte(';')
+		case 's':
+			b.WriteByte(' ')
+		case 'r':
+			b.WriteByte('\r')
+		case 'n':
+			b.WriteByte('\n')
+		default:
+			b.WriteByte(s[i])
+		}
+	}
+	return b.String()
+}
+
+// irc_parse_tags parses IRCv3 message tags, without the leading @. The same encoding
+// is used for soju network attributes.
+func irc_parse_tags(s string) map[string]string {
+	ret := make(map[string]string)
+	for _, x := range strings.Split(s, ";") {
+		if x == "" {
+			continue
+		}
+		parts := strings.SplitN(x, "=", 2)
+		if len(parts) == 2 {
+			ret[parts[0]] = irc_unescape_tag(parts[1])
+		} else {
+			ret[parts[0]] = ""
+		}
+	}
+	return ret
+}
+
+// irc_message_context records the time of the message being processed and whether it
+// is playback, either because it belongs to a history batch or because its server time
+// precedes our registration
+func irc_message_context(tags map[string]string) {
+	runtime.msgTime = time.Time{}
+	runtime.playback = false
+
+	if v, ok := tags["time"]; ok {
+		tm, err := time.Parse(time.RFC3339Nano, v)
+		if err != nil {
+			irclog.Debugf("ignoring malformed server time %q", v)
+		} else {
+			runtime.msgTime = tm
+		}
+	}
+	if ref, ok := tags["batch"]; ok {
+		switch runtime.cap.batches[ref] {
+		case "chathistory", "znc.in/playback":
+			runtime.playback = true
+		}
+	}
+	if !runtime.msgTime.IsZero() && !runtime.registeredAt.IsZero() &&
+		runtime.msgTime.Before(runtime.registeredAt.Add(-playbackSkew)) {
+		runtime.playback = true
+	}
+}
+
+// irc_cap_end completes capability negotiation once nothing is outstanding
+func irc_cap_end() {
+	if !runtime.cap.negotiating || runtime.cap.saslPending || runtime.cap.bindPending {
+		return
+	}
+	runtime.cap.negotiating = false
+	runtime.ircout <- []byte("CAP END")
+}
+
+func irc_handle_cap(args []string) {
+	if len(args) < 5 {
+		return
+	}
+	switch args[3] {
+	case "LS":
+		// A * before the list indicates more lines follow
+		more := args[4] == "*"
+		list := irc_trailing(args, 4)
+		if more {
+			list = irc_trailing(args, 5)
+		}
+		if runtime.cap.available == nil {
+			runtime.cap.available = make(map[string]string)
+		}
+		for _, x := range strings.Fields(list) {
+			parts := strings.SplitN(x, "=", 2)
+			runtime.cap.available[parts[0]] = ""
+			if len(parts) == 2 {
+				runtime.cap.available[parts[0]] = parts[1]
+			}
+		}
+		if more || !runtime.cap.negotiating {
+			return
+		}
+
+		var req []string
+		for _, x := range irc_caps_wanted() {
+			if _, ok := runtime.cap.available[x]; ok {
+				req = append(req, x)
+			}
+		}
+		if config.SaslUser != "" && !containsFold(req, "sasl") {
+			irc_sasl_failed("server does not support SASL")
+		}
+		if config.Bouncer.Network != "" && !containsFold(req, "soju.im/bouncer-networks") {
+			irclog.Warnf("server does not support bouncer networks, not binding to %v",
+				config.Bouncer.Network)
+		}
+		if len(req) == 0 {
+			irc_cap_end()
+			return
+		}
+		irclog.Printf("requesting capabilities: %v", strings.Join(req, " "))
+		runtime.ircout <- []byte(fmt.Sprintf("CAP REQ :%v", strings.Join(req, " ")))
+	case "ACK":
+		if runtime.cap.enabled == nil {
+			runtime.cap.enabled = make(map[string]bool)
+		}
+		for _, x := range strings.Fields(irc_trailing(args, 4)) {
+			if strings.HasPrefix(x, "-") {
+				delete(runtime.cap.enabled, x[1:])
+				continue
+			}
+			runtime.cap.enabled[x] = true
+		}
+		if !runtime.cap.negotiating {
+			return
+		}
+		if runtime.cap.enabled["sasl"] && !runtime.cap.saslPending {
+			irclog.Print("attempting SASL authentication")
+			runtime.cap.saslPending = true
+			runtime.ircout <- []byte("AUTHENTICATE PLAIN")
+		}
+		if runtime.cap.enabled["soju.im/bouncer-networks"] && !runtime.cap.bindPending {
+			runtime.cap.bindPending = true
+			runtime.ircout <- []byte("BOUNCER LISTNETWORKS")
+		}
+		irc_cap_end()
+	case "NAK":
+		req := strings.Fields(irc_trailing(args, 4))
+		irclog.Warnf("server refused capabilities: %v", strings.Join(req, " "))
+		if containsFold(req, "sasl") {
+			irc_sasl_failed("server refused the sasl capability")
+		}
+		irc_cap_end()
+	}
+}
+
+// irc_sasl_done records the end of SASL authentication, successful or not
+func irc_sasl_done() {
+	runtime.cap.saslPending = false
+	irc_cap_end()
+}
+
+func irc_handle_batch(args []string) {
+	if len(args) < 3 || len(args[2]) < 2 {
+		return
+	}
+	ref := args[2][1:]
+	if runtime.cap.batches == nil {
+		runtime.cap.batches = make(map[string]string)
+	}
+	if args[2][0] == '+' {
+		if len(args) >= 4 {
+			runtime.cap.batches[ref] = args[3]
+		}
+		return
+	}
+	typ := runtime.cap.batches[ref]
+	delete(runtime.cap.batches, ref)
+	if typ == "soju.im/bouncer-networks" && runtime.cap.bindPending {
+		irclog.Warnf("bouncer network %v not found", config.Bouncer.Network)
+		irc_bind_done()
+	}
+}
+
+func irc_bind_done() {
+	runtime.cap.bindPending = false
+	irc_cap_end()
+}
+
+// irc_handle_bouncer looks for the configured network in the BOUNCER NETWORK replies
+// to LISTNETWORKS and binds the connection to it
+func irc_handle_bouncer(args []string) {
+	if len(args) < 5 || args[2] != "NETWORK" || !runtime.cap.bindPending {
+		return
+	}
+	attrs := irc_parse_tags(irc_trailing(args, 4))
+	if !strings.EqualFold(attrs["name"], config.Bouncer.Network) {
+		return
+	}
+	irclog.Printf("binding to bouncer network %v (%v)", attrs["name"], args[3])
+	runtime.ircout <- []byte(fmt.Sprintf("BOUNCER BIND %v", args[3]))
+	irc_bind_done()
+}
+
+// irc_handle_fail handles standard FAIL replies, of interest only while binding
+func irc_handle_fail(args []string) {
+	if len(args) < 3 || args[2] != "BOUNCER" || !runtime.cap.bindPending {
+		return
+	}
+	irclog.Warnf("error binding to bouncer network %v: %v", config.Bouncer.Network,
+		strings.Join(args[3:], " "))
+	irc_bind_done()
+}
@@ -0,0 +1,212 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math/rand"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// clockNow returns the current time; protocol handling and modules use it in place of
+// time.Now so replay mode can substitute a fake clock
+var clockNow = time.Now
+
+// fakeClock is a clock that only moves when set, used when replaying a capture
+type fakeClock struct {
+	sync.Mutex
+	t time.Time
+}
+
+func (f *fakeClock) now() time.Time {
+	f.Lock()
+	defer f.Unlock()
+	return f.t
+}
+
+func (f *fakeClock) set(t time.Time) {
+	f.Lock()
+	f.t = t
+	f.Unlock()
+}
+
+const (
+	CAPTURE_IN   = "<"
+	CAPTURE_OUT  = ">"
+	CAPTURE_META = "!" // Connection events
+)
+
+// captureFile records the raw protocol stream, each line is written as a timestamp,
+// the direction and the line itself separated by a single space
+type captureFile struct {
+	sync.Mutex
+	fd *os.File
+}
+
+var capture captureFile
+
+func (c *captureFile) open(p string) error {
+	fd, err := os.OpenFile(p, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	c.Lock()
+	c.fd = fd
+	c.Unlock()
+	return nil
+}
+
+func (c *captureFile) record(dir string, line string) {
+	c.Lock()
+	defer c.Unlock()
+	if c.fd == nil {
+		return
+	}
+	// Outgoing credentials are never written to the capture
+	if dir == CAPTURE_OUT {
+		line = logRedactCredentials(line)
+	}
+	_, err := fmt.Fprintf(c.fd, "%v %v %v\n", time.Now().UTC().Format(time.RFC3339Nano),
+		dir, line)
+	if err != nil {
+		netlog.Warnf("error writing capture: %v", err)
+	}
+}
+
+type captureRecord struct {
+	time time.Time
+	dir  string
+	line string
+}
+
+func captureRead(p string) ([]captureRecord, error) {
+	fd, err := os.Open(p)
+	if err != nil {
+		return nil, err
+	}
+	defer fd.Close()
+
+	var ret []captureRecord
+	sc := bufio.NewScanner(fd)
+	sc.Buffer(make([]byte, 0, 4096), 1024*1024)
+	n := 0
+	for sc.Scan() {
+		n++
+		if sc.Text() == "" {
+			continue
+		}
+		parts := strings.SplitN(sc.Text(), " ", 3)
+		if len(parts) < 2 {
+			return nil, fmt.Errorf("%v: line %v: malformed record", p, n)
+		}
+		tm, err := time.Parse(time.RFC3339Nano, parts[0])
+		if err != nil {
+			return nil, fmt.Errorf("%v: line %v: %v", p, n, err)
+		}
+		rec := captureRecord{time: tm, dir: parts[1]}
+		if len(parts) == 3 {
+			rec.line = parts[2]
+		}
+		ret = append(ret, rec)
+	}
+	return ret, sc.Err()
+}
+
+// replay feeds the incoming lines and connection events of a capture through the
+// protocol handler with the configured modules, using a clock that follows the
+// recorded timestamps. Anything the bot would have sent is written to out in capture
+// format for comparison with the outgoing lines in the original capture. Quote
+// providers make no requests, so the output only depends on the capture and any file
+// providers configured.
+func replay(confpath string, p string, out io.Writer) int {
+	var err error
+	configPath = confpath
+	config, err = loadCfg(confpath)
+	if err != nil {
+		logger.Errorf("error loading configuration: %v", err)
+		return EXIT_ERROR
+	}
+	err = logConfigure(config.Log)
+	if err != nil {
+		logger.Errorf("error configuring logging: %v", err)
+		return EXIT_ERROR
+	}
+	// Replaying must never modify the state persisted by a live bot
+	config.StateDir = ""
+	quoteOffline = true
+
+	records, err := captureRead(p)
+	if err != nil {
+		logger.Errorf("error reading capture: %v", err)
+		return EXIT_ERROR
+	}
+	if len(records) == 0 {
+		logger.Errorf("capture %v is empty", p)
+		return EXIT_ERROR
+	}
+
+	fc := &fakeClock{t: records[0].time}
+	clockNow = fc.now
+	writerRand = rand.New(rand.NewSource(records[0].time.UnixNano()))
+
+	runtime.stateInit()
+	err = moduleRegistration()
+	if err != nil {
+		logger.Errorf("error during module registration: %v", err)
+		return EXIT_ERROR
+	}
+
+	// Background fetches are waited for so replies come out in the same order each
+	// time, with the quote providers offline they complete straight away
+	drain := func() {
+		for runtime.fetching > 0 {
+			runtime.fetchDone(<-runtime.fetched)
+		}
+		for {
+			select {
+			case buf := <-runtime.ircout:
+				fmt.Fprintf(out, "%v %v %v\n", fc.now().UTC().Format(time.RFC3339Nano),
+					CAPTURE_OUT, logRedactCredentials(string(buf)))
+			default:
+				return
+			}
+		}
+	}
+
+	// irc_periodic normally runs every 5 seconds, run it for each 5 second step of
+	// the recorded clock
+	lastPeriodic := records[0].time
+	for _, rec := range records {
+		for rec.time.Sub(lastPeriodic) >= 5*time.Second {
+			lastPeriodic = lastPeriodic.Add(5 * time.Second)
+			fc.set(lastPeriodic)
+			irc_periodic()
+			drain()
+		}
+		fc.set(rec.time)
+
+		switch rec.dir {
+		case CAPTURE_IN:
+			logger.Debugf("replay: %v", logRedact(rec.line))
+			irc_input([]byte(rec.line))
+		case CAPTURE_META:
+			// The connection routines aren't running, act on connection events
+			// as the IRC handler would
+			if strings.HasPrefix(rec.line, "connected") {
+				irc_meta(IRC_META_REGISTER)
+			} else if rec.line == "disconnected" {
+				runtime.connected = false
+				runtime.resetStatus()
+			}
+		default:
+			continue
+		}
+		drain()
+	}
+
+	logger.Printf("replayed %v records", len(records))
+	return EXIT_OK
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestReplay(t *testing.T) {
+	symbolCache = nil
+	defer func() {
+		runtime.shutdownModules()
+		runtime = kruntime{}
+		quoteOffline = false
+		clockNow = time.Now
+		logConfigure(logCfg{})
+	}()
+
+	// The yahoo provider in the configuration makes no requests, quotes come from
+	// the file provider that follows it
+	var b bytes.Buffer
+	if ret := replay("testdata/replay.yaml", "testdata/replay.capture", &b); ret != EXIT_OK {
+		t.Fatalf("replay exited with %v", ret)
+	}
+	got := strings.Split(strings.TrimSpace(b.String()), "\n")
+
+	// Everything sent in the original capture should be reproduced, including
+	// registration following each connection
+	records, err := captureRead("testdata/replay.capture")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var want []string
+	for _, x := range records {
+		if x.dir == CAPTURE_OUT {
+			want = append(want, fmt.Sprintf("%v %v %v",
+				x.time.UTC().Format(time.RFC3339Nano), x.dir, x.line))
+		}
+	}
+	if strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Fatalf("unexpected replay output %q", got)
+	}
+}
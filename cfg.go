@@ -1,12 +1,52 @@
 package main
 
 import (
+	"fmt"
 	"gopkg.in/yaml.v2"
 	"io/ioutil"
+	"net"
+	"net/url"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
 )
 
 type httpCfg struct {
-	UserAgent string
+	UserAgent      string
+	Timeout        string // Limit for a whole request, 10s if unset
+	ConnectTimeout string // Limit for connecting to the server, 5s if unset
+	Retries        *int   // Retries for failed requests, 2 if unset
+}
+
+type quoteProviderCfg struct {
+	Type       string // yahoo, stooq or file
+	URL        string // Endpoint for yahoo and stooq, if not the public service
+	HistoryURL string // Price history endpoint for yahoo and stooq
+	Path       string // Quote file for the file provider
+	Suffix     string // Market appended to stooq symbols without one, .us if unset
+}
+
+type tickerLayoutCfg struct {
+	Layout string
+	Color  *bool // Inherited from the ticker if unset
+}
+
+type tickerAlertCfg struct {
+	Interval   string   // How often alerts are checked, 5m if unset
+	Hysteresis *float64 // Percentage the price must move back to rearm an alert, 1 if unset
+	Max        int      // Alerts each nick may have, 10 if unset
+}
+
+type tickerReportsCfg struct {
+	Exchange      string   // Exchange the reports follow, the calendar default if unset
+	Open          bool     // Post a report when the exchange opens
+	Close         bool     // Post a summary when the exchange closes
+	Indices       []string // Index symbols included in the reports
+	Movers        int      // Gainers and losers in the close report, 3 if unset
+	OpenTemplate  string   // text/template for the open report, see tickerReport
+	CloseTemplate string   // text/template for the close report
 }
 
 type tickerCfg struct {
@@ -17,6 +57,19 @@ type tickerCfg struct {
 	ExecuteOnJoin        bool
 	ScheduleUTCStartHour int
 	ScheduleUTCStopHour  int
+	Workers              int    // Symbols fetched concurrently, 4 if unset
+	CacheTTL             string // How long looked up quotes are reused, 1m if unset
+	// Exchange calendar data file, used instead of the schedule hours if set
+	Calendar string
+	Sessions string // regular or extended, extended includes pre and post market
+	// Quote sources tried in order, yahoo if unset
+	Providers []quoteProviderCfg
+	Layout    string // compact or table, compact if unset
+	Color     bool   // Show gains in green and losses in red
+	// Layout overrides by channel
+	Layouts map[string]tickerLayoutCfg
+	Alerts  tickerAlertCfg
+	Reports tickerReportsCfg
 }
 
 type writerCfg struct {
@@ -25,6 +78,59 @@ type writerCfg struct {
 	Interval string
 }
 
+type logCfg struct {
+	Level           string            // Default level, debug, info, warn or error
+	Format          string            // text or json
+	File            string            // Default destination, stdout if unset
+	Levels          map[string]string // Per subsystem levels, e.g. net, irc, module:ticker
+	Files           map[string]string // Per subsystem destinations
+	PrivateMessages bool              // Include the contents of private messages in logs
+}
+
+type chanlogCfg struct {
+	Datapath      string
+	Format        string // text or json
+	Channels      []string
+	CompressAfter int
+	GrepDays      int
+	GrepMax       int
+}
+
+type tlsCfg struct {
+	MinVersion   string   // 1.0, 1.1, 1.2 or 1.3
+	CAFile       string   // PEM bundle used in place of the system roots
+	Fingerprints []string // Pinned SHA-256 certificate fingerprints
+}
+
+type connectionCfg struct {
+	Proxy       string // socks5://[user:pass@]host:port or http://[user:pass@]host:port
+	BindAddress string // Local address to connect from
+	Family      string // Preferred family, ipv4 or ipv6, the other is tried if it fails
+}
+
+type nickservCfg struct {
+	Account  string   // Account to identify as, the nick if unset
+	Password string   // Used with IDENTIFY if SASL is unavailable
+	Channels []string // Channels only joined once identified
+	Confirm  string   // Pattern matching the NickServ notice confirming identification
+
+	confirm *regexp.Regexp // Compiled from Confirm by validate
+}
+
+type chanservCfg struct {
+	Op []string // Channels to request operator status in after joining
+}
+
+type ctcpCfg struct {
+	UserInfo string // Reply to USERINFO, the version if unset
+	Rate     int    // Maximum CTCP replies sent within Interval
+	Interval string
+}
+
+type bouncerCfg struct {
+	Network string // soju network to bind to, for bouncers serving several networks
+}
+
 type cfg struct {
 	Nick         string
 	Servers      []string
@@ -32,13 +138,324 @@ type cfg struct {
 	VerifyCert   bool
 	SaslUser     string
 	SaslPassword string
+	// Server password sent with PASS, used by bouncers such as ZNC and soju
+	ServerPassword string
+	QuitMessage    string
+	StateDir       string
+	Admins         []string // Hostmasks permitted to run admin commands
+	Capture        string   // Record the raw protocol stream to this file
 
-	Http   httpCfg
-	Ticker tickerCfg
-	Writer writerCfg
+	NickServ   nickservCfg
+	ChanServ   chanservCfg
+	Bouncer    bouncerCfg
+	CTCP       ctcpCfg
+	TLS        tlsCfg
+	Connection connectionCfg
+	Log        logCfg
+	Http       httpCfg
+	Ticker     tickerCfg
+	Writer     writerCfg
+	Chanlog    chanlogCfg
+}
+
+// cfgErrors collects every problem found while validating a configuration so they
+// can all be reported at once
+type cfgErrors []string
+
+func (e *cfgErrors) add(field string, format string, a ...interface{}) {
+	*e = append(*e, field+": "+fmt.Sprintf(format, a...))
+}
+
+func (e cfgErrors) Error() string {
+	return "invalid configuration:\n  " + strings.Join(e, "\n  ")
+}
+
+// validateDuration checks a duration string, providing a more useful message than
+// ParseDuration when the unit has been left off
+func validateDuration(e *cfgErrors, field string, val string) {
+	if _, err := strconv.Atoi(val); err == nil && val != "0" {
+		e.add(field, "%q is missing a unit, for example \"%vs\" or \"%vm\"", val, val, val)
+		return
+	}
+	d, err := time.ParseDuration(val)
+	if err != nil {
+		e.add(field, "%q is not a valid duration", val)
+		return
+	}
+	if d < 0 {
+		e.add(field, "%q must not be negative", val)
+	}
+}
+
+func validateChannel(e *cfgErrors, field string, val string) {
+	if val == "" {
+		e.add(field, "a channel is required")
+		return
+	}
+	if val[0] != '#' && val[0] != '&' {
+		e.add(field, "%q is not a channel name, it must begin with # or &", val)
+	}
+	if strings.ContainsAny(val, " ,\x07") {
+		e.add(field, "%q contains characters not permitted in a channel name", val)
+	}
+}
+
+func validateHour(e *cfgErrors, field string, val int) {
+	if val < 0 || val > 23 {
+		e.add(field, "%v is not an hour between 0 and 23", val)
+	}
 }
 
 func (c *cfg) validate() error {
+	var e cfgErrors
+
+	if c.Nick == "" {
+		e.add("nick", "a nick is required")
+	} else if strings.ContainsAny(c.Nick, " ,*?!@:#&") {
+		e.add("nick", "%q contains characters not permitted in a nick", c.Nick)
+	}
+
+	if len(c.Servers) == 0 {
+		e.add("servers", "at least one server is required")
+	}
+	for i, x := range c.Servers {
+		field := fmt.Sprintf("servers[%v]", i)
+		s, err := net_parse_server(x)
+		if err != nil {
+			e.add(field, "%q must be host:port, ircs://host:port or irc://host:port: %v",
+				x, err)
+			continue
+		}
+		host, port, _ := net.SplitHostPort(s.addr)
+		if host == "" {
+			e.add(field, "%q has no host", x)
+		}
+		if n, err := strconv.Atoi(port); err != nil || n < 1 || n > 65535 {
+			e.add(field, "%q has an invalid port", x)
+		}
+	}
+
+	if c.Connection.Proxy != "" {
+		if _, err := net_parse_proxy(c.Connection.Proxy); err != nil {
+			e.add("connection.proxy", "%v", err)
+		}
+	}
+	if c.Connection.BindAddress != "" {
+		ip := net.ParseIP(c.Connection.BindAddress)
+		if ip == nil {
+			e.add("connection.bindaddress", "%q is not an IP address",
+				c.Connection.BindAddress)
+		} else if (c.Connection.Family == "ipv4" && ip.To4() == nil) ||
+			(c.Connection.Family == "ipv6" && ip.To4() != nil) {
+			e.add("connection.bindaddress", "%q does not match family %v",
+				c.Connection.BindAddress, c.Connection.Family)
+		}
+	}
+	if c.Connection.Family != "" && c.Connection.Family != "ipv4" &&
+		c.Connection.Family != "ipv6" {
+		e.add("connection.family", "%q must be ipv4 or ipv6", c.Connection.Family)
+	}
+
+	if _, ok := tlsVersions[c.TLS.MinVersion]; c.TLS.MinVersion != "" && !ok {
+		e.add("tls.minversion", "%q must be one of 1.0, 1.1, 1.2 or 1.3", c.TLS.MinVersion)
+	}
+	if c.TLS.CAFile != "" {
+		if _, err := os.Stat(c.TLS.CAFile); err != nil {
+			e.add("tls.cafile", "%v", err)
+		}
+	}
+	for i, x := range c.TLS.Fingerprints {
+		if _, err := net_parse_fingerprint(x); err != nil {
+			e.add(fmt.Sprintf("tls.fingerprints[%v]", i), "%v", err)
+		}
+	}
+
+	for i, x := range c.Channels {
+		validateChannel(&e, fmt.Sprintf("channels[%v]", i), x)
+	}
+
+	if c.SaslUser != "" && c.SaslPassword == "" {
+		e.add("saslpassword", "required when sasluser is set")
+	}
+	if c.SaslUser == "" && c.SaslPassword != "" {
+		e.add("sasluser", "required when saslpassword is set")
+	}
+
+	if c.NickServ.Confirm != "" {
+		re, err := regexp.Compile(c.NickServ.Confirm)
+		if err != nil {
+			e.add("nickserv.confirm", "%v", err)
+		}
+		c.NickServ.confirm = re
+	}
+	for i, x := range c.NickServ.Channels {
+		validateChannel(&e, fmt.Sprintf("nickserv.channels[%v]", i), x)
+	}
+	for i, x := range c.ChanServ.Op {
+		validateChannel(&e, fmt.Sprintf("chanserv.op[%v]", i), x)
+	}
+
+	if c.StateDir != "" {
+		fi, err := os.Stat(c.StateDir)
+		if err != nil {
+			e.add("statedir", "%v", err)
+		} else if !fi.IsDir() {
+			e.add("statedir", "%q is not a directory", c.StateDir)
+		}
+	}
+
+	for i, x := range c.Admins {
+		if x == "" {
+			e.add(fmt.Sprintf("admins[%v]", i), "mask must not be empty")
+		}
+	}
+
+	if _, err := parseLogLevel(c.Log.Level); c.Log.Level != "" && err != nil {
+		e.add("log.level", "%v", err)
+	}
+	if c.Log.Format != "" && c.Log.Format != "text" && c.Log.Format != "json" {
+		e.add("log.format", "%q must be text or json", c.Log.Format)
+	}
+	for k, v := range c.Log.Levels {
+		if _, err := parseLogLevel(v); err != nil {
+			e.add("log.levels."+k, "%v", err)
+		}
+	}
+
+	if c.Ticker.Interval != "" {
+		validateDuration(&e, "ticker.interval", c.Ticker.Interval)
+		validateChannel(&e, "ticker.channel", c.Ticker.Channel)
+		if len(c.Ticker.Symbols) == 0 {
+			e.add("ticker.symbols", "at least one symbol is required")
+		}
+		for i, x := range c.Ticker.Symbols {
+			if x == "" || strings.ContainsAny(x, " /?#&") {
+				e.add(fmt.Sprintf("ticker.symbols[%v]", i), "%q is not a valid symbol", x)
+			}
+		}
+		validateLayout := func(field string, val string) {
+			if val != "" && val != "compact" && val != "table" {
+				e.add(field, "%q must be compact or table", val)
+			}
+		}
+		validateLayout("ticker.layout", c.Ticker.Layout)
+		for k, v := range c.Ticker.Layouts {
+			validateChannel(&e, "ticker.layouts", k)
+			validateLayout(fmt.Sprintf("ticker.layouts[%v].layout", k), v.Layout)
+		}
+		if c.Ticker.Sessions != "" && c.Ticker.Sessions != "regular" &&
+			c.Ticker.Sessions != "extended" {
+			e.add("ticker.sessions", "%q must be regular or extended", c.Ticker.Sessions)
+		}
+		if (c.Ticker.Reports.Open || c.Ticker.Reports.Close) && c.Ticker.Calendar == "" {
+			e.add("ticker.reports", "reports need ticker.calendar for the session times")
+		}
+		if c.Ticker.Reports.Movers < 0 {
+			e.add("ticker.reports.movers", "%v must not be negative", c.Ticker.Reports.Movers)
+		}
+		if c.Ticker.CacheTTL != "" {
+			validateDuration(&e, "ticker.cachettl", c.Ticker.CacheTTL)
+		}
+		if c.Ticker.Alerts.Interval != "" {
+			validateDuration(&e, "ticker.alerts.interval", c.Ticker.Alerts.Interval)
+		}
+		if h := c.Ticker.Alerts.Hysteresis; h != nil && (*h < 0 || *h >= 100) {
+			e.add("ticker.alerts.hysteresis", "%v must be at least 0 and below 100", *h)
+		}
+		if c.Ticker.Alerts.Max < 0 {
+			e.add("ticker.alerts.max", "%v must not be negative", c.Ticker.Alerts.Max)
+		}
+		if c.Ticker.Workers < 0 {
+			e.add("ticker.workers", "%v must not be negative", c.Ticker.Workers)
+		}
+		for i, x := range c.Ticker.Providers {
+			field := fmt.Sprintf("ticker.providers[%v]", i)
+			switch x.Type {
+			case "yahoo", "stooq":
+				for k, v := range map[string]string{"url": x.URL, "historyurl": x.HistoryURL} {
+					if v == "" {
+						continue
+					}
+					u, err := url.Parse(v)
+					if err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+						e.add(field+"."+k, "%q must be an http or https URL", v)
+					}
+				}
+			case "file":
+				if x.Path == "" {
+					e.add(field+".path", "a path is required for the file provider")
+				}
+			default:
+				e.add(field+".type", "%q must be yahoo, stooq or file", x.Type)
+			}
+		}
+		validateHour(&e, "ticker.scheduleutcstarthour", c.Ticker.ScheduleUTCStartHour)
+		validateHour(&e, "ticker.scheduleutcstophour", c.Ticker.ScheduleUTCStopHour)
+		if c.Ticker.ScheduleUTCStartHour > c.Ticker.ScheduleUTCStopHour {
+			e.add("ticker.scheduleutcstarthour", "%v is after scheduleutcstophour %v",
+				c.Ticker.ScheduleUTCStartHour, c.Ticker.ScheduleUTCStopHour)
+		}
+	}
+
+	if c.Writer.Interval != "" {
+		validateDuration(&e, "writer.interval", c.Writer.Interval)
+		d, err := time.ParseDuration(c.Writer.Interval)
+		if err == nil && d != 0 {
+			validateChannel(&e, "writer.channel", c.Writer.Channel)
+		}
+		if c.Writer.Datapath == "" {
+			e.add("writer.datapath", "a data path is required")
+		} else {
+			fi, err := os.Stat(c.Writer.Datapath)
+			if err != nil {
+				e.add("writer.datapath", "%v", err)
+			} else if !fi.IsDir() {
+				e.add("writer.datapath", "%q is not a directory", c.Writer.Datapath)
+			}
+		}
+	}
+
+	if c.Http.Timeout != "" {
+		validateDuration(&e, "http.timeout", c.Http.Timeout)
+	}
+	if c.Http.ConnectTimeout != "" {
+		validateDuration(&e, "http.connecttimeout", c.Http.ConnectTimeout)
+	}
+	if c.Http.Retries != nil && *c.Http.Retries < 0 {
+		e.add("http.retries", "%v must not be negative", *c.Http.Retries)
+	}
+
+	if c.CTCP.Rate < 0 {
+		e.add("ctcp.rate", "%v must not be negative", c.CTCP.Rate)
+	}
+	if c.CTCP.Interval != "" {
+		validateDuration(&e, "ctcp.interval", c.CTCP.Interval)
+	}
+
+	if c.Chanlog.Datapath != "" {
+		fi, err := os.Stat(c.Chanlog.Datapath)
+		if err != nil {
+			e.add("chanlog.datapath", "%v", err)
+		} else if !fi.IsDir() {
+			e.add("chanlog.datapath", "%q is not a directory", c.Chanlog.Datapath)
+		}
+		if c.Chanlog.Format != "" && c.Chanlog.Format != "text" && c.Chanlog.Format != "json" {
+			e.add("chanlog.format", "%q must be text or json", c.Chanlog.Format)
+		}
+		for i, x := range c.Chanlog.Channels {
+			validateChannel(&e, fmt.Sprintf("chanlog.channels[%v]", i), x)
+		}
+		if c.Chanlog.GrepDays < 0 {
+			e.add("chanlog.grepdays", "%v must not be negative", c.Chanlog.GrepDays)
+		}
+		if c.Chanlog.GrepMax < 0 {
+			e.add("chanlog.grepmax", "%v must not be negative", c.Chanlog.GrepMax)
+		}
+	}
+
+	if len(e) > 0 {
+		return e
+	}
 	return nil
 }
 
@@ -50,11 +467,35 @@ func loadCfg(confpath string) (*cfg, error) {
 	}
 
 	var ret cfg
-	err = yaml.Unmarshal(buf, &ret)
+	// Decode strictly so misspelled or unknown keys are reported rather than
+	// silently ignored
+	err = yaml.UnmarshalStrict(buf, &ret)
+	if err != nil {
+		return nil, err
+	}
+	err = expandSecrets(&ret)
 	if err != nil {
 		return nil, err
 	}
 
+	if ret.QuitMessage == "" {
+		ret.QuitMessage = "kraz " + version
+	}
+	if ret.CTCP.Rate == 0 {
+		ret.CTCP.Rate = 5
+	}
+	if ret.CTCP.Interval == "" {
+		ret.CTCP.Interval = "30s"
+	}
+	if ret.Chanlog.CompressAfter == 0 {
+		ret.Chanlog.CompressAfter = 1
+	}
+	if ret.Chanlog.GrepDays == 0 {
+		ret.Chanlog.GrepDays = 7
+	}
+	if ret.Chanlog.GrepMax == 0 {
+		ret.Chanlog.GrepMax = 3
+	}
 	if ret.Ticker.ScheduleUTCStartHour == 0 {
 		ret.Ticker.ScheduleUTCStartHour = 13
 	}
@@ -62,5 +503,9 @@ func loadCfg(confpath string) (*cfg, error) {
 		ret.Ticker.ScheduleUTCStopHour = 21
 	}
 
-	return &ret, ret.validate()
+	err = ret.validate()
+	if err != nil {
+		return nil, err
+	}
+	return &ret, nil
 }
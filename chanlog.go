@@ -0,0 +1,461 @@
+package main
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+var chanlogger = newLogger("module:chanlog")
+
+const chanlogDateFormat = "2006-01-02"
+
+// chanlogEntry is the JSON lines representation of a logged event
+type chanlogEntry struct {
+	Time    time.Time `json:"time"`
+	Type    string    `json:"type"`
+	Channel string    `json:"channel"`
+	Nick    string    `json:"nick"`
+	Ident   string    `json:"ident,omitempty"`
+	Host    string    `json:"host,omitempty"`
+	Text    string    `json:"text,omitempty"`
+	Target  string    `json:"target,omitempty"` // New nick for nick changes, kicked nick for kicks
+}
+
+type chanlogFile struct {
+	date string
+	fd   *os.File
+}
+
+type chanlog struct {
+	datapath      string
+	json          bool
+	channels      []string // Channels to log, all if empty
+	compressAfter int      // Days after which old files are compressed, negative disables
+	grepDays      int      // Days of history searched by &grep
+	grepMax       int      // Maximum number of matches returned by &grep
+
+	files map[string]*chanlogFile
+	last  map[string]time.Time // Time of the last event logged for each channel
+}
+
+func (c *chanlog) getName() string {
+	return "chanlog"
+}
+
+func (c *chanlog) shouldRun() bool {
+	return false
+}
+
+func (c *chanlog) shouldRunOnJoin(channel string) bool {
+	return false
+}
+
+func (c *chanlog) execute(r *kruntime) error {
+	return nil
+}
+
+func (c *chanlog) initialize() {
+	chanlogger.Print("chanlog initializing")
+	c.files = make(map[string]*chanlogFile)
+	c.last = make(map[string]time.Time)
+	c.compress()
+}
+
+func (c *chanlog) shutdown() error {
+	var ret error
+	for k, v := range c.files {
+		err := v.fd.Close()
+		if err != nil {
+			ret = err
+		}
+		delete(c.files, k)
+	}
+	return ret
+}
+
+func (c *chanlog) logsChannel(channel string) bool {
+	if len(c.channels) == 0 {
+		return true
+	}
+	for _, x := range c.channels {
+		if strings.EqualFold(x, channel) {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *chanlog) extension() string {
+	if c.json {
+		return ".jsonl"
+	}
+	return ".log"
+}
+
+// channelDir returns the directory logs for a channel are stored in, the name is
+// lower cased and anything that would be unsafe in a path is replaced
+func (c *chanlog) channelDir(channel string) string {
+	name := strings.Map(func(r rune) rune {
+		if r == '/' || r == '\\' || r == 0 {
+			return '_'
+		}
+		return r
+	}, strings.ToLower(channel))
+	if name == "." || name == ".." {
+		name = "_"
+	}
+	return path.Join(c.datapath, name)
+}
+
+// file returns the open log file for a channel and date, rotating to a new file if
+// the date has changed since the last write
+func (c *chanlog) file(channel string, tm time.Time) (*os.File, error) {
+	key := strings.ToLower(channel)
+	date := tm.UTC().Format(chanlogDateFormat)
+
+	if f, ok := c.files[key]; ok {
+		if f.date == date {
+			return f.fd, nil
+		}
+		chanlogger.Printf("rotating log for %v", channel)
+		f.fd.Close()
+		delete(c.files, key)
+		c.compress()
+	}
+
+	dir := c.channelDir(channel)
+	err := os.MkdirAll(dir, 0700)
+	if err != nil {
+		return nil, err
+	}
+	fd, err := os.OpenFile(path.Join(dir, date+c.extension()),
+		os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+	c.files[key] = &chanlogFile{date: date, fd: fd}
+	return fd, nil
+}
+
+func (c *chanlog) formatText(ev ircEvent) string {
+	ts := ev.time.UTC().Format("15:04:05")
+	switch ev.command {
+	case "PRIVMSG":
+		return fmt.Sprintf("[%v] <%v> %v", ts, ev.src.nick, ev.text)
+	case "ACTION":
+		return fmt.Sprintf("[%v] * %v %v", ts, ev.src.nick, ev.text)
+	case "JOIN":
+		return fmt.Sprintf("[%v] *** %v (%v@%v) has joined %v", ts, ev.src.nick,
+			ev.src.ident, ev.src.host, ev.target)
+	case "PART":
+		return fmt.Sprintf("[%v] *** %v has left %v (%v)", ts, ev.src.nick, ev.target,
+			ev.text)
+	case "QUIT":
+		return fmt.Sprintf("[%v] *** %v has quit (%v)", ts, ev.src.nick, ev.text)
+	case "NICK":
+		return fmt.Sprintf("[%v] *** %v is now known as %v", ts, ev.src.nick, ev.nick)
+	case "TOPIC":
+		return fmt.Sprintf("[%v] *** %v changes topic to '%v'", ts, ev.src.nick, ev.text)
+	case "KICK":
+		return fmt.Sprintf("[%v] *** %v was kicked by %v (%v)", ts, ev.nick, ev.src.nick,
+			ev.text)
+	}
+	return ""
+}
+
+func (c *chanlog) formatJSON(ev ircEvent) (string, error) {
+	buf, err := json.Marshal(chanlogEntry{
+		Time:    ev.time.UTC(),
+		Type:    strings.ToLower(ev.command),
+		Channel: ev.target,
+		Nick:    ev.src.nick,
+		Ident:   ev.src.ident,
+		Host:    ev.src.host,
+		Text:    ev.text,
+		Target:  ev.nick,
+	})
+	return string(buf), err
+}
+
+func (c *chanlog) handleEvent(ev ircEvent, r *kruntime) {
+	if !c.logsChannel(ev.target) {
+		return
+	}
+	// Bouncer playback is only logged if it covers a period we didn't see, such as
+	// while we were disconnected
+	key := strings.ToLower(ev.target)
+	if ev.playback && !ev.time.After(c.last[key]) {
+		return
+	}
+
+	var line string
+	var err error
+	if c.json {
+		line, err = c.formatJSON(ev)
+		if err != nil {
+			chanlogger.Errorf("chanlog error encoding event: %v", err)
+			return
+		}
+	} else {
+		line = c.formatText(ev)
+	}
+	if line == "" {
+		return
+	}
+
+	fd, err := c.file(ev.target, ev.time)
+	if err != nil {
+		chanlogger.Errorf("chanlog error opening log for %v: %v", ev.target, err)
+		return
+	}
+	_, err = fd.WriteString(line + "\n")
+	if err != nil {
+		chanlogger.Errorf("chanlog error writing log for %v: %v", ev.target, err)
+		return
+	}
+	if ev.time.After(c.last[key]) {
+		c.last[key] = ev.time
+	}
+}
+
+// compress gzips log files older than compressAfter days, the files currently open
+// for writing are never touched
+func (c *chanlog) compress() {
+	if c.compressAfter < 0 {
+		return
+	}
+	cutoff := clockNow().UTC().AddDate(0, 0, -c.compressAfter).Format(chanlogDateFormat)
+	open := make(map[string]bool)
+	for k, v := range c.files {
+		open[path.Join(c.channelDir(k), v.date+c.extension())] = true
+	}
+
+	dirs, err := ioutil.ReadDir(c.datapath)
+	if err != nil {
+		chanlogger.Warnf("chanlog error reading %v: %v", c.datapath, err)
+		return
+	}
+	for _, d := range dirs {
+		if !d.IsDir() {
+			continue
+		}
+		dir := path.Join(c.datapath, d.Name())
+		list, err := ioutil.ReadDir(dir)
+		if err != nil {
+			chanlogger.Warnf("chanlog error reading %v: %v", dir, err)
+			continue
+		}
+		for _, f := range list {
+			ext := path.Ext(f.Name())
+			if ext != ".log" && ext != ".jsonl" {
+				continue
+			}
+			date := strings.TrimSuffix(f.Name(), ext)
+			p := path.Join(dir, f.Name())
+			if date >= cutoff || open[p] {
+				continue
+			}
+			err = chanlogGzip(p)
+			if err != nil {
+				chanlogger.Warnf("chanlog error compressing %v: %v", f.Name(), err)
+			}
+		}
+	}
+}
+
+func chanlogGzip(p string) error {
+	in, err := os.Open(p)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.OpenFile(p+".gz", os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	zw := gzip.NewWriter(out)
+	_, err = io.Copy(zw, in)
+	if err == nil {
+		err = zw.Close()
+	}
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(p + ".gz")
+		return err
+	}
+	return os.Remove(p)
+}
+
+// chanlogReadLines returns the lines of a log file, transparently decompressing it
+func chanlogReadLines(p string) ([]string, error) {
+	fd, err := os.Open(p)
+	if err != nil {
+		return nil, err
+	}
+	defer fd.Close()
+
+	var rd io.Reader = fd
+	if strings.HasSuffix(p, ".gz") {
+		zr, err := gzip.NewReader(fd)
+		if err != nil {
+			return nil, err
+		}
+		defer zr.Close()
+		rd = zr
+	}
+
+	var ret []string
+	sc := bufio.NewScanner(rd)
+	for sc.Scan() {
+		ret = append(ret, sc.Text())
+	}
+	return ret, sc.Err()
+}
+
+// display returns the form of a logged line used in &grep replies along with the
+// message it records, JSON lines are converted back into the text form. Only what was
+// said is searched, events such as joins have no message.
+func (c *chanlog) display(line string) (string, string) {
+	if !c.json {
+		return line, chanlogTextMessage(line)
+	}
+	var e chanlogEntry
+	if json.Unmarshal([]byte(line), &e) != nil {
+		return "", ""
+	}
+	ev := ircEvent{
+		command: strings.ToUpper(e.Type),
+		src:     sourceDescriptor{nick: e.Nick, ident: e.Ident, host: e.Host},
+		target:  e.Channel,
+		text:    e.Text,
+		nick:    e.Target,
+		time:    e.Time,
+	}
+	if ev.command != "PRIVMSG" && ev.command != "ACTION" {
+		return c.formatText(ev), ""
+	}
+	return c.formatText(ev), e.Text
+}
+
+// chanlogTextMessage returns the message from a line in the text format, without
+// the timestamp and nick
+func chanlogTextMessage(line string) string {
+	i := strings.Index(line, "] ")
+	if i == -1 {
+		return ""
+	}
+	line = line[i+2:]
+	switch {
+	case strings.HasPrefix(line, "<"):
+		if i = strings.Index(line, "> "); i != -1 {
+			return line[i+2:]
+		}
+	case strings.HasPrefix(line, "* "):
+		if parts := strings.SplitN(line[2:], " ", 2); len(parts) == 2 {
+			return parts[1]
+		}
+	}
+	return ""
+}
+
+// grep searches the most recent grepDays days of history for channel, returning up
+// to grepMax matches with the most recent last
+func (c *chanlog) grep(channel string, re *regexp.Regexp) ([]string, error) {
+	dir := c.channelDir(channel)
+	list, err := ioutil.ReadDir(dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	cutoff := clockNow().UTC().AddDate(0, 0, -c.grepDays).Format(chanlogDateFormat)
+	var files []string
+	for _, f := range list {
+		if len(f.Name()) < len(chanlogDateFormat) {
+			continue
+		}
+		if f.Name()[:len(chanlogDateFormat)] >= cutoff {
+			files = append(files, f.Name())
+		}
+	}
+	sort.Sort(sort.Reverse(sort.StringSlice(files)))
+
+	var ret []string
+	for _, f := range files {
+		lines, err := chanlogReadLines(path.Join(dir, f))
+		if err != nil {
+			return nil, err
+		}
+		for i := len(lines) - 1; i >= 0; i-- {
+			out, text := c.display(lines[i])
+			if text == "" || strings.HasPrefix(text, "&grep") {
+				continue
+			}
+			if !re.MatchString(text) {
+				continue
+			}
+			ret = append([]string{fmt.Sprintf("%v %v", f[:len(chanlogDateFormat)], out)},
+				ret...)
+			if len(ret) >= c.grepMax {
+				return ret, nil
+			}
+		}
+	}
+	return ret, nil
+}
+
+func (c *chanlog) handlesCommand(cmd string) bool {
+	return cmd == "&grep"
+}
+
+func (c *chanlog) handleCommand(src sourceDescriptor, cmd string, args []string, r *kruntime) {
+	target := args[2]
+	if !c.logsChannel(target) {
+		return
+	}
+	pattern := irc_trailing(args, 4)
+	if pattern == "" {
+		r.out.privmsg(target, "[grep] usage: &grep <pattern>")
+		return
+	}
+
+	re, err := regexp.Compile("(?i)" + pattern)
+	if err != nil {
+		re = regexp.MustCompile("(?i)" + regexp.QuoteMeta(pattern))
+	}
+
+	// Searching several days of compressed logs can be slow, it is done in the
+	// background like quote lookups
+	r.background(func() func() {
+		matches, err := c.grep(target, re)
+		return func() {
+			if err != nil {
+				chanlogger.Errorf("chanlog error searching %v: %v", target, err)
+				return
+			}
+			if len(matches) == 0 {
+				r.out.privmsg(target, fmt.Sprintf("[grep] no matches in the last %v days",
+					c.grepDays))
+				return
+			}
+			for _, x := range matches {
+				r.out.privmsg(target, "[grep] "+x)
+			}
+		}
+	})
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"regexp"
+	"testing"
+	"time"
+)
+
+func TestChanlog(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kraz")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	now := time.Date(2026, 3, 2, 12, 0, 0, 0, time.UTC)
+	clockNow = func() time.Time { return now }
+	defer func() { clockNow = time.Now }()
+
+	c := &chanlog{datapath: dir, grepDays: 7, grepMax: 2}
+	c.initialize()
+	defer c.shutdown()
+	say := func(channel string, nick string, text string) {
+		c.handleEvent(ircEvent{command: "PRIVMSG", src: sourceDescriptor{nick: nick},
+			target: channel, text: text, time: now}, nil)
+	}
+	exists := func(p string) bool {
+		_, err := os.Stat(path.Join(dir, p))
+		return err == nil
+	}
+
+	say("#a", "alice", "first day")
+	say("#B", "bob", "first day")
+	say("#a", "alice", "&grep day")
+
+	// Rotating #a compresses its previous file but not the one #b still has open
+	now = now.AddDate(0, 0, 1)
+	say("#a", "alice", "second day")
+	if !exists("#a/2026-03-02.log.gz") || exists("#a/2026-03-02.log") {
+		t.Fatal("rotated log was not compressed")
+	}
+	if !exists("#b/2026-03-02.log") || exists("#b/2026-03-02.log.gz") {
+		t.Fatal("open log was compressed")
+	}
+	say("#b", "bob", "second day")
+	if !exists("#b/2026-03-02.log.gz") || !exists("#b/2026-03-03.log") {
+		t.Fatal("rotated log was not compressed")
+	}
+
+	// Matches come from compressed and open files, most recent last and limited to
+	// grepMax, &grep commands are never matched
+	say("#a", "alice", "third day")
+	got, err := c.grep("#a", regexp.MustCompile("(?i)DAY"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{
+		"2026-03-03 [12:00:00] <alice> second day",
+		"2026-03-03 [12:00:00] <alice> third day",
+	}
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Fatalf("unexpected matches %q", got)
+	}
+	got, err = c.grep("#a", regexp.MustCompile("first"))
+	if err != nil || len(got) != 1 || got[0] != "2026-03-02 [12:00:00] <alice> first day" {
+		t.Fatalf("unexpected matches %q (%v)", got, err)
+	}
+
+	// Only the message is searched, not the timestamp or nick
+	for _, x := range []string{"alice", "12:00"} {
+		got, err = c.grep("#a", regexp.MustCompile(x))
+		if err != nil || len(got) != 0 {
+			t.Fatalf("%v: unexpected matches %q (%v)", x, got, err)
+		}
+	}
+
+	// The search runs in the background
+	oc := &outputCapture{}
+	r := newCaptureRuntime(oc)
+	c.handleCommand(sourceDescriptor{nick: "alice"}, "&grep",
+		[]string{":alice!a@h", "PRIVMSG", "#a", ":&grep", "third"}, r)
+	if len(oc.calls) != 0 {
+		t.Fatalf("unexpected calls before the search completed %v", oc.calls)
+	}
+	runFetches(t, r)
+	if len(oc.calls) != 1 ||
+		oc.calls[0].text != "[grep] 2026-03-03 [12:00:00] <alice> third day" {
+		t.Fatalf("unexpected calls %v", oc.calls)
+	}
+
+	// Files older than grepDays aren't searched
+	now = now.AddDate(0, 0, 8)
+	got, err = c.grep("#a", regexp.MustCompile("first"))
+	if err != nil || len(got) != 0 {
+		t.Fatalf("unexpected matches %q (%v)", got, err)
+	}
+}
+
+func TestChanlogJSON(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kraz")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	now := time.Date(2026, 3, 2, 12, 0, 0, 0, time.UTC)
+	clockNow = func() time.Time { return now }
+	defer func() { clockNow = time.Now }()
+
+	c := &chanlog{datapath: dir, json: true, grepDays: 7, grepMax: 5}
+	c.initialize()
+	defer c.shutdown()
+	src := sourceDescriptor{nick: "alice", ident: "a", host: "h"}
+	for _, ev := range []ircEvent{
+		{command: "JOIN", src: src},
+		{command: "PRIVMSG", src: src, text: "hello"},
+		{command: "ACTION", src: src, text: "waves"},
+		{command: "TOPIC", src: src, text: "hello world"},
+	} {
+		ev.target = "#a"
+		ev.time = now
+		c.handleEvent(ev, nil)
+	}
+
+	// Matches are the same as in the text format
+	for _, x := range []struct {
+		pattern string
+		want    []string
+	}{
+		{"alice", nil},
+		{"hello", []string{"2026-03-02 [12:00:00] <alice> hello"}},
+		{"wave", []string{"2026-03-02 [12:00:00] * alice waves"}},
+	} {
+		got, err := c.grep("#a", regexp.MustCompile(x.pattern))
+		if err != nil || fmt.Sprint(got) != fmt.Sprint(x.want) {
+			t.Errorf("%v: unexpected matches %q (%v)", x.pattern, got, err)
+		}
+	}
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+const ctcpDelim = "\x01"
+
+// Source advertised in reply to CTCP SOURCE
+const sourceURL = "https://github.com/ameihm0912/kraz"
+
+// Minimum time between replies to the same host, in addition to the configured limit
+// across all sources
+var ctcpHostInterval = 5 * time.Second
+
+// ctcpCommands are the queries we understand, in the form listed by CLIENTINFO
+var ctcpCommands = []string{"ACTION", "CLIENTINFO", "PING", "SOURCE", "TIME", "USERINFO",
+	"VERSION"}
+
+// ctcpLimiter limits replies to CTCP queries so we can't be used to flood someone, or
+// flooded off the server ourselves
+type ctcpLimiter struct {
+	sent  []time.Time          // Replies sent within the current interval
+	hosts map[string]time.Time // Time of the last reply to each host
+}
+
+var ctcpLimit ctcpLimiter
+
+func (l *ctcpLimiter) allow(host string, now time.Time) bool {
+	interval, _ := time.ParseDuration(config.CTCP.Interval)
+
+	n := 0
+	for _, x := range l.sent {
+		if now.Sub(x) < interval {
+			l.sent[n] = x
+			n++
+		}
+	}
+	l.sent = l.sent[:n]
+	if len(l.sent) >= config.CTCP.Rate {
+		return false
+	}
+
+	if l.hosts == nil {
+		l.hosts = make(map[string]time.Time)
+	}
+	for k, v := range l.hosts {
+		if now.Sub(v) >= ctcpHostInterval {
+			delete(l.hosts, k)
+		}
+	}
+	if _, ok := l.hosts[host]; ok {
+		return false
+	}
+
+	l.hosts[host] = now
+	l.sent = append(l.sent, now)
+	return true
+}
+
+// irc_parse_ctcp returns the command and parameters of a CTCP message, ok is false if
+// text is not one. The closing delimiter is optional, some clients omit it.
+func irc_parse_ctcp(text string) (cmd string, params string, ok bool) {
+	if !strings.HasPrefix(text, ctcpDelim) || len(text) < 2 {
+		return "", "", false
+	}
+	text = strings.TrimSuffix(text[1:], ctcpDelim)
+	parts := strings.SplitN(text, " ", 2)
+	cmd = strings.ToUpper(parts[0])
+	if len(parts) == 2 {
+		params = parts[1]
+	}
+	return cmd, params, cmd != ""
+}
+
+// irc_ctcp_reply returns the reply to a CTCP query, ok is false if the query is
+// unknown or doesn't have a reply
+func irc_ctcp_reply(cmd string, params string) (reply string, ok bool) {
+	switch cmd {
+	case "CLIENTINFO":
+		return strings.Join(ctcpCommands, " "), true
+	case "PING":
+		return params, true
+	case "SOURCE":
+		return sourceURL, true
+	case "TIME":
+		return clockNow().Format(time.RFC1123Z), true
+	case "USERINFO":
+		if config.CTCP.UserInfo != "" {
+			return config.CTCP.UserInfo, true
+		}
+		return "kraz " + version, true
+	case "VERSION":
+		return "kraz " + version, true
+	}
+	return "", false
+}
+
+// irc_handle_ctcp handles a CTCP query sent in a PRIVMSG to target. ACTION is
+// delivered to modules as its own event, anything else is answered subject to the
+// rate limit.
+func irc_handle_ctcp(src sourceDescriptor, target string, cmd string, params string) {
+	if cmd == "ACTION" {
+		if strings.HasPrefix(target, "#") {
+			irc_dispatch_event(ircEvent{command: "ACTION", src: src, target: target,
+				text: params})
+		}
+		return
+	}
+	if runtime.playback {
+		return
+	}
+
+	reply, ok := irc_ctcp_reply(cmd, params)
+	if !ok {
+		irclog.Debugf("ignoring unknown CTCP %v from %v", cmd, src.nick)
+		return
+	}
+	if !ctcpLimit.allow(src.host, clockNow()) {
+		irclog.Debugf("rate limited CTCP %v from %v", cmd, src.mask())
+		return
+	}
+	irclog.Debugf("replying to CTCP %v from %v", cmd, src.nick)
+	if reply != "" {
+		reply = " " + reply
+	}
+	runtime.ircout <- []byte(fmt.Sprintf("NOTICE %v :%v%v%v%v", src.nick, ctcpDelim, cmd,
+		reply, ctcpDelim))
+}
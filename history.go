@@ -0,0 +1,453 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var historylog = newLogger("module:history")
+
+// bar is the prices for one interval of a price history
+type bar struct {
+	time  time.Time
+	open  float64
+	high  float64
+	low   float64
+	close float64
+}
+
+// historyProvider is implemented by quote providers that can return a price history
+// for a period, oldest bar first
+type historyProvider interface {
+	history(symbol string, period historyPeriod) ([]bar, error)
+}
+
+// historyPeriod is a period that can be requested with &hist and &spark
+type historyPeriod struct {
+	name     string
+	interval string        // Yahoo bar interval
+	bars     int           // For short periods, the number of daily bars
+	months   int           // For longer periods, the number of months
+	ttl      time.Duration // How long a fetched history is reused
+}
+
+var historyPeriods = []historyPeriod{
+	{name: "1d", interval: "5m", ttl: 5 * time.Minute},
+	{name: "5d", interval: "30m", bars: 5, ttl: 15 * time.Minute},
+	{name: "1mo", interval: "1d", months: 1, ttl: time.Hour},
+	{name: "3mo", interval: "1d", months: 3, ttl: time.Hour},
+	{name: "6mo", interval: "1d", months: 6, ttl: time.Hour},
+	{name: "1y", interval: "1wk", months: 12, ttl: 4 * time.Hour},
+	{name: "5y", interval: "1mo", months: 60, ttl: 12 * time.Hour},
+}
+
+// intraday returns true if the period needs bars shorter than a day
+func (p historyPeriod) intraday() bool {
+	return p.months == 0 && p.bars == 0
+}
+
+// historyPeriodFor returns the period called name
+func historyPeriodFor(name string) (historyPeriod, bool) {
+	for _, x := range historyPeriods {
+		if strings.EqualFold(x.name, name) {
+			return x, true
+		}
+	}
+	return historyPeriod{}, false
+}
+
+func (y *yahooProvider) history(symbol string, period historyPeriod) ([]bar, error) {
+	buf, err := y.http.get(y.historyURL + url.PathEscape(symbol) + "?range=" +
+		period.name + "&interval=" + period.interval)
+	if err != nil {
+		return nil, err
+	}
+
+	var resp struct {
+		Chart struct {
+			Result []struct {
+				Timestamp  []int64
+				Indicators struct {
+					Quote []struct {
+						Open  []*float64
+						High  []*float64
+						Low   []*float64
+						Close []*float64
+					}
+				}
+			}
+			Error *struct {
+				Description string
+			}
+		}
+	}
+	err = json.Unmarshal(buf, &resp)
+	if err != nil {
+		return nil, err
+	}
+	if resp.Chart.Error != nil {
+		return nil, fmt.Errorf("%v", resp.Chart.Error.Description)
+	}
+	if len(resp.Chart.Result) == 0 || len(resp.Chart.Result[0].Indicators.Quote) == 0 {
+		return nil, fmt.Errorf("no history for %v", symbol)
+	}
+	res := resp.Chart.Result[0]
+	q := res.Indicators.Quote[0]
+	var ret []bar
+	for i, ts := range res.Timestamp {
+		// Intervals without trades are null
+		if i >= len(q.Close) || i >= len(q.Open) || i >= len(q.High) || i >= len(q.Low) ||
+			q.Close[i] == nil || q.Open[i] == nil || q.High[i] == nil || q.Low[i] == nil {
+			continue
+		}
+		ret = append(ret, bar{time: time.Unix(ts, 0), open: *q.Open[i], high: *q.High[i],
+			low: *q.Low[i], close: *q.Close[i]})
+	}
+	return ret, nil
+}
+
+// history returns daily bars from stooq, which has no intraday history
+func (s *stooqProvider) history(symbol string, period historyPeriod) ([]bar, error) {
+	if period.intraday() {
+		return nil, fmt.Errorf("stooq has no intraday history")
+	}
+	buf, err := s.http.get(s.historyURL + "?s=" + url.QueryEscape(s.symbol(symbol)) +
+		"&i=d")
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := csv.NewReader(strings.NewReader(string(buf))).ReadAll()
+	if err != nil {
+		return nil, err
+	}
+	// Date, open, high, low, close and volume, with a header row. Unknown symbols get
+	// a response with no data rows.
+	var ret []bar
+	for _, row := range rows {
+		if len(row) < 5 {
+			continue
+		}
+		tm, err := time.Parse("2006-01-02", row[0])
+		if err != nil {
+			continue
+		}
+		var v [4]float64
+		for i := range v {
+			v[i], err = strconv.ParseFloat(row[i+1], 64)
+			if err != nil {
+				break
+			}
+		}
+		if err != nil {
+			continue
+		}
+		ret = append(ret, bar{time: tm, open: v[0], high: v[1], low: v[2], close: v[3]})
+	}
+	if len(ret) == 0 {
+		return nil, fmt.Errorf("no history for %v", symbol)
+	}
+	return historyTrim(ret, period, clockNow()), nil
+}
+
+// historyTrim returns the bars within period ending at now
+func historyTrim(bars []bar, period historyPeriod, now time.Time) []bar {
+	if period.bars > 0 {
+		if len(bars) > period.bars {
+			return bars[len(bars)-period.bars:]
+		}
+		return bars
+	}
+	since := now.AddDate(0, -period.months, 0)
+	i := sort.Search(len(bars), func(i int) bool { return !bars[i].time.Before(since) })
+	return bars[i:]
+}
+
+// fileBar is a bar in the history of a fileQuote
+type fileBar struct {
+	Time  time.Time
+	Open  float64
+	High  float64
+	Low   float64
+	Close float64
+}
+
+func (f *fileProvider) history(symbol string, period historyPeriod) ([]bar, error) {
+	v, err := f.load(symbol)
+	if err != nil {
+		return nil, err
+	}
+	h, ok := v.History[period.name]
+	if !ok {
+		return nil, fmt.Errorf("no %v history for %v", period.name, symbol)
+	}
+	var ret []bar
+	for _, x := range h {
+		ret = append(ret, bar{time: x.Time, open: x.Open, high: x.High, low: x.Low,
+			close: x.Close})
+	}
+	return ret, nil
+}
+
+// historyFetch returns the history from the first provider that has one
+func historyFetch(providers []quoteProvider, symbol string, period historyPeriod) ([]bar,
+	error) {
+	var errs []string
+	for _, p := range providers {
+		h, ok := p.(historyProvider)
+		if !ok {
+			continue
+		}
+		bars, err := h.history(symbol, period)
+		if err == nil && len(bars) > 0 {
+			return bars, nil
+		}
+		if err == nil {
+			err = fmt.Errorf("empty history")
+		}
+		historylog.Debugf("history %v provider failed for %v: %v", p.getName(), symbol, err)
+		errs = append(errs, fmt.Sprintf("%v: %v", p.getName(), err))
+	}
+	if len(errs) == 0 {
+		return nil, fmt.Errorf("no provider supports price history")
+	}
+	return nil, fmt.Errorf("no history for %v (%v)", symbol, strings.Join(errs, "; "))
+}
+
+// Characters used to draw sparklines, lowest first
+var sparkBlocks = []rune("▁▂▃▄▅▆▇█")
+
+// Longest sparkline drawn, longer histories are sampled down to this
+const sparkMax = 40
+
+// sparkline draws the closing prices of bars
+func sparkline(bars []bar) string {
+	var closes []float64
+	if len(bars) <= sparkMax {
+		for _, x := range bars {
+			closes = append(closes, x.close)
+		}
+	} else {
+		// The last close in each group of bars, so the final point is the latest price
+		for i := 1; i <= sparkMax; i++ {
+			closes = append(closes, bars[i*len(bars)/sparkMax-1].close)
+		}
+	}
+	low, high := math.Inf(1), math.Inf(-1)
+	for _, x := range closes {
+		low = math.Min(low, x)
+		high = math.Max(high, x)
+	}
+	var b strings.Builder
+	for _, x := range closes {
+		i := 0
+		if high > low {
+			i = int(math.Round((x - low) / (high - low) * float64(len(sparkBlocks)-1)))
+		}
+		b.WriteRune(sparkBlocks[i])
+	}
+	return b.String()
+}
+
+// historySummary is the open, high, low and close over a history
+type historySummary struct {
+	open, high, low, close float64
+	percent                float64 // Change from the open to the close
+}
+
+func summarize(bars []bar) historySummary {
+	s := historySummary{open: bars[0].open, close: bars[len(bars)-1].close,
+		high: math.Inf(-1), low: math.Inf(1)}
+	for _, x := range bars {
+		s.high = math.Max(s.high, x.high)
+		s.low = math.Min(s.low, x.low)
+	}
+	if s.open != 0 {
+		s.percent = (s.close - s.open) / s.open * 100
+	}
+	return s
+}
+
+// historyEntry is a cached history
+type historyEntry struct {
+	bars    []bar
+	fetched time.Time
+}
+
+// historyEntryState is the persisted form of a historyEntry
+type historyEntryState struct {
+	Bars    []fileBar
+	Fetched time.Time
+}
+
+// Histories by symbol and period, kept outside the module so they survive a
+// configuration reload
+var historyCache map[string]historyEntry
+
+type history struct {
+	providers []quoteProvider
+}
+
+func historyKey(symbol string, period historyPeriod) string {
+	return symbol + " " + period.name
+}
+
+// historyExpired returns true if the cache entry for key is too old to be used
+func historyExpired(key string, e historyEntry) bool {
+	parts := strings.SplitN(key, " ", 2)
+	period, ok := historyPeriodFor(parts[len(parts)-1])
+	return !ok || clockNow().Sub(e.fetched) >= period.ttl
+}
+
+func (h *history) initialize() {
+	historylog.Print("history initializing")
+	if historyCache != nil {
+		return
+	}
+	historyCache = make(map[string]historyEntry)
+
+	var saved map[string]historyEntryState
+	err := stateLoad(h.getName(), &saved)
+	if err != nil {
+		historylog.Errorf("history error loading state: %v", err)
+		return
+	}
+	for k, v := range saved {
+		e := historyEntry{fetched: v.Fetched}
+		for _, x := range v.Bars {
+			e.bars = append(e.bars, bar{time: x.Time, open: x.Open, high: x.High,
+				low: x.Low, close: x.Close})
+		}
+		historyCache[k] = e
+	}
+}
+
+func (h *history) shutdown() error {
+	saved := make(map[string]historyEntryState)
+	for k, v := range historyCache {
+		if historyExpired(k, v) {
+			// Expired entries would only be fetched again
+			continue
+		}
+		s := historyEntryState{Fetched: v.fetched}
+		for _, x := range v.bars {
+			s.Bars = append(s.Bars, fileBar{Time: x.time, Open: x.open, High: x.high,
+				Low: x.low, Close: x.close})
+		}
+		saved[k] = s
+	}
+	return stateSave(h.getName(), saved)
+}
+
+func (h *history) getName() string {
+	return "history"
+}
+
+func (h *history) shouldRun() bool {
+	return false
+}
+
+func (h *history) shouldRunOnJoin(channel string) bool {
+	return false
+}
+
+func (h *history) execute(r *kruntime) error {
+	return nil
+}
+
+func (h *history) handlesCommand(cmd string) bool {
+	return cmd == "&hist" || cmd == "&spark"
+}
+
+func (h *history) handlesQuery(cmd string) bool {
+	return h.handlesCommand(cmd)
+}
+
+// lookup passes the history of symbol over period to done, from the cache if it was
+// fetched recently enough and otherwise once a background fetch completes
+func (h *history) lookup(r *kruntime, symbol string, period historyPeriod,
+	done func([]bar, error)) {
+	key := historyKey(symbol, period)
+	if e, ok := historyCache[key]; ok && !historyExpired(key, e) {
+		done(e.bars, nil)
+		return
+	}
+	r.background(func() func() {
+		bars, err := historyFetch(h.providers, symbol, period)
+		return func() {
+			if err != nil {
+				done(nil, err)
+				return
+			}
+			// Drop expired entries so the cache doesn't grow with every symbol ever
+			// asked for
+			for k, v := range historyCache {
+				if historyExpired(k, v) {
+					delete(historyCache, k)
+				}
+			}
+			historyCache[key] = historyEntry{bars: bars, fetched: clockNow()}
+			done(bars, nil)
+		}
+	})
+}
+
+// handleCommand handles &hist <symbol> [period] and &spark <symbol> [period]
+func (h *history) handleCommand(src sourceDescriptor, cmd string, args []string, r *kruntime) {
+	tag := "[" + cmd[1:] + "]"
+	var names []string
+	for _, x := range historyPeriods {
+		names = append(names, x.name)
+	}
+	params := irc_params(args)
+	if len(params) < 1 {
+		r.out.reply(src, args, fmt.Sprintf("%v usage: %v <symbol> [%v]", tag, cmd,
+			strings.Join(names, "|")))
+		return
+	}
+	symbol := strings.ToUpper(params[0])
+	if strings.ContainsAny(symbol, "/?#&") {
+		r.out.reply(src, args, fmt.Sprintf("%v %q is not a valid symbol", tag, params[0]))
+		return
+	}
+	name := "1mo"
+	if cmd == "&spark" {
+		name = "1d"
+	}
+	if len(params) >= 2 {
+		name = params[1]
+	}
+	period, ok := historyPeriodFor(name)
+	if !ok {
+		r.out.reply(src, args, fmt.Sprintf("%v unknown period %q, use one of %v", tag, name,
+			strings.Join(names, " ")))
+		return
+	}
+
+	h.lookup(r, symbol, period, func(bars []bar, err error) {
+		if err != nil {
+			historylog.Warnf("history error in fetch data: %v", err)
+			r.out.reply(src, args, fmt.Sprintf("%v no %v history found for %v", tag,
+				period.name, symbol))
+			return
+		}
+		s := summarize(bars)
+		if cmd == "&spark" {
+			r.out.reply(src, args, fmt.Sprintf("%v %v %v %v %v (%+.2f%%) low %v high %v",
+				tag, symbol, period.name, sparkline(bars), quoteFormatPrice(s.close),
+				s.percent, quoteFormatPrice(s.low), quoteFormatPrice(s.high)))
+			return
+		}
+		r.out.reply(src, args, fmt.Sprintf("%v %v %v open %v high %v low %v close %v "+
+			"(%+.2f%%) %v", tag, symbol, period.name, quoteFormatPrice(s.open),
+			quoteFormatPrice(s.high), quoteFormatPrice(s.low), quoteFormatPrice(s.close),
+			s.percent, sparkline(bars)))
+	})
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestHistory(t *testing.T) {
+	m := newModuleTest(t)
+	historyCache = nil
+	defer func() { historyCache = nil }()
+	now := time.Date(2026, 10, 19, 20, 0, 0, 0, time.UTC)
+	clockNow = func() time.Time { return now }
+	defer func() { clockNow = time.Now }()
+
+	requests := 0
+	yahoo := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		if r.URL.Path != "/MSFT" {
+			w.Write([]byte(`{"chart":{"result":null,"error":{"code":"Not Found",
+				"description":"No data found, symbol may be delisted"}}}`))
+			return
+		}
+		if r.URL.Query().Get("range") != "1d" || r.URL.Query().Get("interval") != "5m" {
+			t.Errorf("unexpected query %v", r.URL.RawQuery)
+		}
+		w.Write([]byte(`{"chart":{"result":[{"timestamp":[1,2,3,4,5],
+			"indicators":{"quote":[{"open":[100,101,null,103,104],
+			"high":[102,103,null,105,106],"low":[99,100,null,102,103],
+			"close":[101,102,null,104,110]}]}}],"error":null}}`))
+	}))
+	defer yahoo.Close()
+
+	stooq := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		if r.URL.Query().Get("s") != "aapl.us" {
+			w.Write([]byte("No data"))
+			return
+		}
+		w.Write([]byte("Date,Open,High,Low,Close,Volume\r\n" +
+			"2026-08-14,180,185,179,184,1000\r\n" +
+			"2026-09-21,190,192,188,191,1000\r\n" +
+			"2026-10-16,195,201,194,200,1000\r\n"))
+	}))
+	defer stooq.Close()
+
+	providers, err := newQuoteProviders([]quoteProviderCfg{
+		{Type: "yahoo", HistoryURL: yahoo.URL + "/"},
+		{Type: "stooq", HistoryURL: stooq.URL},
+	}, httpCfg{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := &history{providers: providers}
+	h.initialize()
+	command := func(line string) string {
+		return m.reply(h, sourceDescriptor{nick: "alice"}, "#test", line)
+	}
+
+	want := "[spark] MSFT 1d ▁▂▃█ 110.00 (+10.00%) low 99.00 high 106.00"
+	if got := command("&spark msft"); got != want {
+		t.Fatalf("got %q, wanted %q", got, want)
+	}
+	// Cached until the TTL for the period expires
+	if got := command("&spark MSFT 1d"); got != want || requests != 1 {
+		t.Fatalf("got %q after %v requests", got, requests)
+	}
+	now = now.Add(10 * time.Minute)
+	command("&spark MSFT")
+	if requests != 2 {
+		t.Fatalf("history not fetched again after expiring")
+	}
+
+	// Yahoo has no AAPL, the daily history from stooq is trimmed to the period
+	if got := command("&hist AAPL"); got !=
+		"[hist] AAPL 1mo open 190.00 high 201.00 low 188.00 close 200.00 (+5.26%) ▁█" {
+		t.Fatalf("unexpected reply %q", got)
+	}
+	// Repeated spaces are ignored
+	if got := command("&hist  AAPL  2w"); !strings.HasPrefix(got,
+		`[hist] unknown period "2w"`) {
+		t.Fatalf("unexpected reply %q", got)
+	}
+	if got := command("&hist NONE 1y"); got != "[hist] no 1y history found for NONE" {
+		t.Fatalf("unexpected reply %q", got)
+	}
+}
+
+func TestSparkline(t *testing.T) {
+	var bars []bar
+	for i := 0; i < 100; i++ {
+		bars = append(bars, bar{close: float64(i)})
+	}
+	s := []rune(sparkline(bars))
+	if len(s) != sparkMax || s[0] != '▁' || s[len(s)-1] != '█' {
+		t.Fatalf("unexpected sparkline %q", string(s))
+	}
+	if got := sparkline([]bar{{close: 5}, {close: 5}}); got != "▁▁" {
+		t.Fatalf("unexpected flat sparkline %q", got)
+	}
+}
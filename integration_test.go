@@ -0,0 +1,317 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ameihm0912/kraz/ircdtest"
+)
+
+const testTimeout = 5 * time.Second
+
+// echoModule replies to &echo with its arguments, used to verify command dispatch
+type echoModule struct{}
+
+func (e *echoModule) getName() string                { return "echo" }
+func (e *echoModule) shouldRun() bool                { return false }
+func (e *echoModule) shouldRunOnJoin(string) bool    { return false }
+func (e *echoModule) execute(*kruntime) error        { return nil }
+func (e *echoModule) initialize()                    {}
+func (e *echoModule) shutdown() error                { return nil }
+func (e *echoModule) handlesCommand(cmd string) bool { return cmd == "&echo" }
+
+func (e *echoModule) handleCommand(src sourceDescriptor, cmd string, args []string, r *kruntime) {
+	r.out.reply(src, args, irc_trailing(args, 4))
+}
+
+// tellModule sends &tell messages, reporting nicks the server says don't exist, and
+// records the network name from the 005 sent at registration
+type tellModule struct {
+	echoModule
+	network chan string
+}
+
+func (e *tellModule) getName() string                { return "tell" }
+func (e *tellModule) handlesCommand(cmd string) bool { return cmd == "&tell" }
+func (e *tellModule) handlesMessage(cmd string) bool { return cmd == "005" }
+
+func (e *tellModule) handleCommand(src sourceDescriptor, cmd string, args []string, r *kruntime) {
+	if len(args) < 6 {
+		return
+	}
+	channel := args[2]
+	r.sendWithReply(args[4], func(out output) error {
+		return out.privmsg(args[4], irc_trailing(args, 5))
+	}, func(msg ircMessage) {
+		if msg.command == "401" {
+			r.out.privmsg(channel, "no such nick "+msg.subject())
+		}
+	})
+}
+
+func (e *tellModule) handleMessage(msg ircMessage, r *kruntime) {
+	for _, x := range msg.params {
+		if strings.HasPrefix(x, "NETWORK=") {
+			select {
+			case e.network <- strings.TrimPrefix(x, "NETWORK="):
+			default:
+			}
+		}
+	}
+}
+
+func expect(t *testing.T, srv *ircdtest.Server, prefix string) string {
+	t.Helper()
+	l, err := srv.Expect(prefix, testTimeout)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return l
+}
+
+// startBot runs the connection and protocol handlers with configuration c. The
+// returned function shuts the bot down and returns the exit status; the protocol
+// handler exits on shutdown so another bot can be started afterwards.
+func startBot(c *cfg, mods ...module) func() int {
+	config = c
+	resetDelay = 10 * time.Millisecond
+	periodicInterval = 50 * time.Millisecond
+	joinRetryInterval = 100 * time.Millisecond
+	reconnectDelay = 50 * time.Millisecond
+	writeInterval = time.Millisecond
+
+	logConfigure(logCfg{Level: "warn"})
+	runtime = kruntime{}
+	shouldReset = false
+	ctcpLimit = ctcpLimiter{}
+	runtime.stateInit()
+	for _, m := range mods {
+		runtime.addModule(m)
+	}
+	go entry()
+	go irc_handler()
+	return shutdown
+}
+
+func expectRegistration(t *testing.T, srv *ircdtest.Server) {
+	t.Helper()
+	if err := srv.WaitConnected(testTimeout); err != nil {
+		t.Fatal(err)
+	}
+	expect(t, srv, "CAP LS 302")
+	expect(t, srv, "NICK kraz")
+	expect(t, srv, "USER kraz")
+	expect(t, srv, "CAP REQ :sasl")
+	expect(t, srv, "AUTHENTICATE PLAIN")
+	expect(t, srv, "AUTHENTICATE ")
+	expect(t, srv, "CAP END")
+	expect(t, srv, "JOIN #test")
+}
+
+// TestIntegration drives the connection and protocol handlers against the fake
+// server, the steps share a single bot and run in order
+func TestIntegration(t *testing.T) {
+	srv, err := ircdtest.NewTLSServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+	srv.SaslUser = "kraz"
+	srv.SaslPassword = "secret"
+	srv.Nicks = []string{"alice", "bob"}
+	tell := &tellModule{network: make(chan string, 1)}
+
+	stop := startBot(&cfg{
+		Nick:         "kraz",
+		Servers:      []string{srv.Addr},
+		Channels:     []string{"#test"},
+		SaslUser:     "kraz",
+		SaslPassword: "secret",
+		QuitMessage:  "test shutdown",
+		CTCP:         ctcpCfg{Rate: 5, Interval: "30s"},
+	}, &echoModule{}, tell)
+
+	ok := t.Run("register", func(t *testing.T) {
+		expectRegistration(t, srv)
+	})
+	ok = ok && t.Run("numeric", func(t *testing.T) {
+		select {
+		case n := <-tell.network:
+			if n != "test" {
+				t.Fatalf("unexpected network %q", n)
+			}
+		case <-time.After(testTimeout):
+			t.Fatal("timed out waiting for 005")
+		}
+	})
+	ok = ok && t.Run("reply", func(t *testing.T) {
+		srv.Privmsg("alice", "#test", "&tell bob hello")
+		expect(t, srv, "PRIVMSG bob :hello")
+		srv.Privmsg("alice", "#test", "&tell carol hello")
+		l := expect(t, srv, "PRIVMSG #test")
+		if l != "PRIVMSG #test :no such nick carol" {
+			t.Fatalf("unexpected reply %q", l)
+		}
+	})
+	ok = ok && t.Run("command", func(t *testing.T) {
+		srv.Privmsg("alice", "#test", "&echo hello world")
+		l := expect(t, srv, "PRIVMSG #test")
+		if l != "PRIVMSG #test :hello world" {
+			t.Fatalf("unexpected reply %q", l)
+		}
+	})
+	ok = ok && t.Run("ctcp", func(t *testing.T) {
+		srv.Privmsg("alice", "kraz", "\x01VERSION\x01")
+		l := expect(t, srv, "NOTICE alice")
+		if l != "NOTICE alice :\x01VERSION kraz "+version+"\x01" {
+			t.Fatalf("unexpected reply %q", l)
+		}
+		// A second query from the same host is rate limited, and plain text that
+		// looks like a query is not one
+		srv.Privmsg("alice", "kraz", "\x01PING 1234\x01")
+		srv.Privmsg("alice", "#test", "PING")
+		srv.Privmsg("alice", "#test", "&echo done")
+		l = expect(t, srv, "")
+		if l != "PRIVMSG #test :done" {
+			t.Fatalf("unexpected line %q", l)
+		}
+	})
+	ok = ok && t.Run("kick", func(t *testing.T) {
+		srv.Kick("#test", "op", "out")
+		expect(t, srv, "JOIN #test")
+	})
+	ok = ok && t.Run("reconnect", func(t *testing.T) {
+		srv.Disconnect()
+		expectRegistration(t, srv)
+		if srv.Connections() != 2 {
+			t.Fatalf("expected 2 connections, got %v", srv.Connections())
+		}
+		srv.Privmsg("alice", "#test", "&echo again")
+		expect(t, srv, "PRIVMSG #test :again")
+	})
+	ok = ok && t.Run("shutdown", func(t *testing.T) {
+		done := make(chan int)
+		go func() {
+			done <- stop()
+		}()
+		l := expect(t, srv, "QUIT")
+		if !strings.HasSuffix(l, ":test shutdown") {
+			t.Fatalf("unexpected quit %q", l)
+		}
+		select {
+		case ret := <-done:
+			if ret != EXIT_OK {
+				t.Fatalf("shutdown returned %v", ret)
+			}
+		case <-time.After(testTimeout):
+			t.Fatal("timed out waiting for shutdown")
+		}
+	})
+}
+
+// TestServices covers a server password, falling back to NickServ when the server
+// refuses SASL, holding registered only channels until identified and requesting
+// operator status from ChanServ
+func TestServices(t *testing.T) {
+	srv, err := ircdtest.NewServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+	srv.Password = "bouncer"
+	srv.NickServPassword = "nspass"
+
+	stop := startBot(&cfg{
+		Nick:           "kraz",
+		Servers:        []string{"irc://" + srv.Addr},
+		Channels:       []string{"#test", "#reg"},
+		SaslUser:       "kraz",
+		SaslPassword:   "secret",
+		ServerPassword: "bouncer",
+		NickServ:       nickservCfg{Password: "nspass", Channels: []string{"#reg"}},
+		ChanServ:       chanservCfg{Op: []string{"#test"}},
+	})
+	defer stop()
+
+	if err := srv.WaitConnected(testTimeout); err != nil {
+		t.Fatal(err)
+	}
+	expect(t, srv, "PASS bouncer")
+	expect(t, srv, "CAP LS 302")
+	expect(t, srv, "NICK kraz")
+	expect(t, srv, "CAP END")
+	expect(t, srv, "PRIVMSG NickServ :IDENTIFY kraz nspass")
+
+	// Identification happens after joining #test, the op request follows it and
+	// #reg is only joined once identified
+	var joins []string
+	deadline := time.Now().Add(testTimeout)
+	for len(joins) < 2 && time.Now().Before(deadline) {
+		l, err := srv.Expect("", testTimeout)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if strings.HasPrefix(l, "JOIN ") {
+			joins = append(joins, l)
+		}
+		if l == "PRIVMSG ChanServ :OP #test kraz" && len(joins) == 0 {
+			t.Fatal("op requested before joining")
+		}
+	}
+	if len(joins) != 2 || joins[1] != "JOIN #reg" {
+		t.Fatalf("unexpected joins %v", joins)
+	}
+	expect(t, srv, "PRIVMSG ChanServ :OP #test kraz")
+}
+
+// TestBouncer binds to a bouncer network and checks commands in playback, either
+// stamped before registration or in a history batch, are not run
+func TestBouncer(t *testing.T) {
+	srv, err := ircdtest.NewServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+	srv.Caps = []string{"server-time", "znc.in/playback", "echo-message"}
+	srv.Networks = []string{"oftc", "libera"}
+
+	stop := startBot(&cfg{
+		Nick:     "kraz",
+		Servers:  []string{"irc://" + srv.Addr},
+		Channels: []string{"#test"},
+		Bouncer:  bouncerCfg{Network: "Libera"},
+	}, &echoModule{})
+	defer stop()
+
+	if err := srv.WaitConnected(testTimeout); err != nil {
+		t.Fatal(err)
+	}
+	l := expect(t, srv, "CAP REQ")
+	if l != "CAP REQ :server-time batch znc.in/playback soju.im/bouncer-networks" {
+		t.Fatalf("unexpected request %q", l)
+	}
+	expect(t, srv, "BOUNCER LISTNETWORKS")
+	expect(t, srv, "BOUNCER BIND 2")
+	expect(t, srv, "CAP END")
+	expect(t, srv, "JOIN #test")
+	if srv.Bound() != "libera" {
+		t.Fatalf("bound to %q", srv.Bound())
+	}
+
+	stamp := func(tm time.Time) string {
+		return tm.UTC().Format("2006-01-02T15:04:05.000Z")
+	}
+	srv.Sendf("@time=%v :alice!alice@test.host PRIVMSG #test :&echo old",
+		stamp(time.Now().Add(-time.Hour)))
+	srv.Sendf(":%v BATCH +hist chathistory #test", "bouncer")
+	srv.Sendf("@batch=hist;time=%v :alice!alice@test.host PRIVMSG #test :&echo batch",
+		stamp(time.Now()))
+	srv.Sendf(":%v BATCH -hist", "bouncer")
+	srv.Sendf("@time=%v :alice!alice@test.host PRIVMSG #test :&echo new",
+		stamp(time.Now()))
+	l = expect(t, srv, "PRIVMSG #test")
+	if l != "PRIVMSG #test :new" {
+		t.Fatalf("unexpected reply %q", l)
+	}
+}
@@ -4,25 +4,47 @@ import (
 	"bytes"
 	"encoding/base64"
 	"fmt"
+	"regexp"
 	"strings"
-	"sync"
 	"time"
 )
 
 const (
 	IRC_META_REGISTER = iota
-	IRC_META_NICKREGISTER
 	IRC_META_RESET
 )
 
 var shouldReset = false
 
+// Protocol handler timings, variables so tests can shorten them
+var (
+	resetDelay        = 30 * time.Second // Delay before signalling readiness after a reset
+	periodicInterval  = 5 * time.Second  // Idle time before irc_periodic runs
+	joinRetryInterval = 30 * time.Second // Minimum time between JOIN attempts
+	identifyTimeout   = 60 * time.Second // Wait for services before warning about channels
+)
+
 type sourceDescriptor struct {
 	isServer bool
 	server   string
 	nick     string
 	ident    string
 	host     string
+	account  string // Services account from the account-tag capability, if logged in
+}
+
+// ircEvent describes channel activity, delivered to modules implementing eventModule
+type ircEvent struct {
+	command string // PRIVMSG, JOIN, PART, QUIT, NICK, TOPIC, KICK or ACTION (CTCP)
+	src     sourceDescriptor
+	target  string // Channel the event applies to
+	text    string // Message, reason or topic
+	nick    string // New nick for NICK, the kicked nick for KICK
+	time    time.Time
+
+	// Replayed by a bouncer from before we connected, commands are not run for
+	// playback and channel state is not updated
+	playback bool
 }
 
 func (src *sourceDescriptor) isMe() bool {
@@ -33,6 +55,14 @@ func (src *sourceDescriptor) isMe() bool {
 	return false
 }
 
+// mask returns the source in nick!ident@host form
+func (src *sourceDescriptor) mask() string {
+	if src.isServer {
+		return src.server
+	}
+	return fmt.Sprintf("%v!%v@%v", src.nick, src.ident, src.host)
+}
+
 func irc_parse_source(src string) (sourceDescriptor, error) {
 	var ret sourceDescriptor
 
@@ -57,13 +87,8 @@ func irc_parse_source(src string) (sourceDescriptor, error) {
 	return ret, nil
 }
 
-func irc_handler(wg *sync.WaitGroup) {
-	defer func() {
-		logger.Print("irc handler exiting")
-		wg.Done()
-	}()
-
-	logger.Print("irc handler starting")
+func irc_handler() {
+	irclog.Print("irc handler starting")
 
 	for {
 		if shouldReset {
@@ -73,9 +98,11 @@ func irc_handler(wg *sync.WaitGroup) {
 			for {
 				select {
 				case buf := <-runtime.ircin:
-					logger.Printf("irc_input (discard): %v", string(buf))
+					irclog.Debugf("irc_input (discard): %v", logRedact(string(buf)))
 				case meta := <-runtime.ircmeta:
-					logger.Printf("irc_meta (discard): %v", string(meta))
+					irclog.Debugf("irc_meta (discard): %v", meta)
+				case f := <-runtime.fetched:
+					runtime.fetchDone(f)
 				default:
 					done = true
 				}
@@ -86,8 +113,8 @@ func irc_handler(wg *sync.WaitGroup) {
 			shouldReset = false
 
 			// Notify entry we are ready and nothing remains in the channels
-			logger.Print("irc_handler: ready for new connections")
-			time.Sleep(time.Second * 30) // Wait 30 seconds before the signal
+			irclog.Print("irc_handler: ready for new connections")
+			time.Sleep(resetDelay)
 			runtime.ircreset <- true
 		}
 
@@ -96,7 +123,18 @@ func irc_handler(wg *sync.WaitGroup) {
 			irc_input(buf)
 		case meta := <-runtime.ircmeta:
 			irc_meta(meta)
-		case <-time.After(5 * time.Second):
+		case f := <-runtime.fetched:
+			runtime.fetchDone(f)
+		case <-runtime.ircshutdown:
+			irc_shutdown()
+			irclog.Print("irc handler exiting")
+			return
+		case <-runtime.ircreload:
+			err := irc_reload()
+			if err != nil {
+				irclog.Errorf("configuration reload failed: %v", err)
+			}
+		case <-time.After(periodicInterval):
 			irc_periodic()
 		}
 	}
@@ -115,7 +153,7 @@ func irc_runmodules(isOnJoin bool, channel string) {
 
 		err := m.execute(&runtime)
 		if err != nil {
-			logger.Printf("error in module %v: %v", m.getName(), err)
+			irclog.Errorf("error in module %v: %v", m.getName(), err)
 		}
 	}
 }
@@ -125,34 +163,96 @@ func irc_periodic() {
 		return
 	}
 
+	var waiting []string
 	for i := range runtime.channel {
 		x := &runtime.channel[i]
 		if x.joined {
 			continue
 		}
+		if !runtime.identified && containsFold(config.NickServ.Channels, x.name) {
+			// Channel requires a registered user, wait until services have
+			// confirmed we are identified
+			waiting = append(waiting, x.name)
+			continue
+		}
 		if x.join_sent.IsZero() ||
-			time.Now().After(x.join_sent.Add(time.Duration(time.Second*30))) {
-			x.join_sent = time.Now()
-			logger.Printf("irc_periodic: attempting to join %v", x.name)
+			clockNow().After(x.join_sent.Add(joinRetryInterval)) {
+			x.join_sent = clockNow()
+			irclog.Printf("irc_periodic: attempting to join %v", x.name)
 			runtime.ircout <- []byte(fmt.Sprintf("JOIN %v", x.name))
 		}
 	}
+	if len(waiting) > 0 && !runtime.identifyWarned &&
+		clockNow().Sub(runtime.registeredAt) >= identifyTimeout {
+		irclog.Warnf("not identified to services after %v, not joining %v until "+
+			"identified", identifyTimeout, strings.Join(waiting, ", "))
+		runtime.identifyWarned = true
+	}
 
 	irc_runmodules(false, "")
 }
 
+// irc_trailing returns the message arguments from position i onwards as a single
+// string with the leading : removed
+func irc_trailing(args []string, i int) string {
+	if len(args) <= i {
+		return ""
+	}
+	return strings.TrimPrefix(strings.Join(args[i:], " "), ":")
+}
+
+// irc_params returns the arguments given to a command, without the empty arguments
+// repeated spaces would otherwise leave
+func irc_params(args []string) []string {
+	return strings.Fields(irc_trailing(args, 4))
+}
+
+func irc_dispatch_event(ev ircEvent) {
+	if ev.time.IsZero() {
+		ev.time = runtime.msgTime
+	}
+	if ev.time.IsZero() {
+		ev.time = clockNow()
+	}
+	ev.playback = runtime.playback
+	for _, m := range runtime.modules {
+		if e, ok := m.(eventModule); ok {
+			e.handleEvent(ev, &runtime)
+		}
+	}
+}
+
+// irc_dispatch_event_shared dispatches an event that is not tied to a channel, such
+// as QUIT or NICK, once for each channel the user was seen in
+func irc_dispatch_event_shared(ev ircEvent, channels []string) {
+	for _, x := range channels {
+		ev.target = x
+		irc_dispatch_event(ev)
+	}
+}
+
 func irc_command(src sourceDescriptor, args []string) {
-	if !strings.HasPrefix(args[2], "#") {
+	cmd := args[3][1:]
+
+	if irc_admin_command(src, cmd, args) {
 		return
 	}
 
-	cmd := args[3][1:]
-	logger.Printf("processing command %v", cmd)
+	private := !strings.HasPrefix(args[2], "#")
+
+	irclog.Debugf("processing command %v", cmd)
 
 	for i := range runtime.modules {
 		m := runtime.modules[i]
+		if private {
+			// Commands sent directly to us only go to modules that accept them
+			q, ok := m.(queryModule)
+			if !ok || !q.handlesQuery(cmd) {
+				continue
+			}
+		}
 		if m.handlesCommand(cmd) {
-			logger.Printf("dispatching %v command to %v module", cmd, m.getName())
+			irclog.Debugf("dispatching %v command to %v module", cmd, m.getName())
 			m.handleCommand(src, cmd, args, &runtime)
 		}
 	}
@@ -166,15 +266,94 @@ func irc_handle_join(src sourceDescriptor, args []string) {
 	if channame[0] == ':' {
 		channame = channame[1:]
 	}
+	if runtime.playback {
+		irc_dispatch_event(ircEvent{command: "JOIN", src: src, target: channame})
+		return
+	}
 	if src.isMe() {
-		logger.Printf("marking %v as joined", channame)
+		irclog.Printf("marking %v as joined", channame)
 		runtime.markChannelJoined(channame, true)
+		runtime.clearMembers(channame)
+		if runtime.identified {
+			irc_request_op(channame)
+		}
 	}
+	runtime.addMember(channame, src.nick)
+	irc_dispatch_event(ircEvent{command: "JOIN", src: src, target: channame})
 
 	// Run any modules configured to execute on join
 	irc_runmodules(true, channame)
 }
 
+func irc_handle_part(src sourceDescriptor, args []string) {
+	if len(args) < 3 {
+		return
+	}
+	channame := strings.TrimPrefix(args[2], ":")
+
+	irc_dispatch_event(ircEvent{command: "PART", src: src, target: channame,
+		text: irc_trailing(args, 3)})
+	if runtime.playback {
+		return
+	}
+	if src.isMe() {
+		irclog.Printf("marking %v as parted", channame)
+		runtime.markChannelJoined(channame, false)
+		runtime.clearMembers(channame)
+		return
+	}
+	runtime.removeMember(channame, src.nick)
+}
+
+func irc_handle_quit(src sourceDescriptor, args []string) {
+	if runtime.playback {
+		// Membership at the time is unknown, so the event can't be attributed to
+		// channels
+		return
+	}
+	channels := runtime.removeMemberAll(src.nick)
+	irc_dispatch_event_shared(ircEvent{command: "QUIT", src: src,
+		text: irc_trailing(args, 2)}, channels)
+}
+
+func irc_handle_nick(src sourceDescriptor, args []string) {
+	if len(args) < 3 {
+		return
+	}
+	newnick := strings.TrimPrefix(args[2], ":")
+	if runtime.playback {
+		return
+	}
+	channels := runtime.renameMember(src.nick, newnick)
+	irc_dispatch_event_shared(ircEvent{command: "NICK", src: src, nick: newnick},
+		channels)
+}
+
+func irc_handle_topic(src sourceDescriptor, args []string) {
+	if len(args) < 3 {
+		return
+	}
+	irc_dispatch_event(ircEvent{command: "TOPIC", src: src, target: args[2],
+		text: irc_trailing(args, 3)})
+}
+
+// irc_handle_names records channel membership from a RPL_NAMREPLY
+func irc_handle_names(args []string) {
+	if len(args) < 6 {
+		return
+	}
+	channame := args[4]
+	for i, x := range args[5:] {
+		if i == 0 {
+			x = strings.TrimPrefix(x, ":")
+		}
+		x = strings.TrimLeft(x, "~&@%+")
+		if x != "" {
+			runtime.addMember(channame, x)
+		}
+	}
+}
+
 func irc_handle_kick(src sourceDescriptor, args []string) {
 	if len(args) < 4 {
 		return
@@ -182,10 +361,18 @@ func irc_handle_kick(src sourceDescriptor, args []string) {
 	channame := args[2]
 	kicked := args[3]
 
+	irc_dispatch_event(ircEvent{command: "KICK", src: src, target: channame,
+		nick: kicked, text: irc_trailing(args, 4)})
+	if runtime.playback {
+		return
+	}
 	if kicked == config.Nick {
-		logger.Printf("marking %v as parted", channame)
+		irclog.Printf("marking %v as parted", channame)
 		runtime.markChannelJoined(channame, false)
+		runtime.clearMembers(channame)
+		return
 	}
+	runtime.removeMember(channame, kicked)
 }
 
 func irc_handle_privmsg(src sourceDescriptor, args []string) {
@@ -193,36 +380,132 @@ func irc_handle_privmsg(src sourceDescriptor, args []string) {
 		return
 	}
 
-	if args[3] == ":PING" {
-		resp := strings.Join(args[3:], " ")
-		runtime.ircout <- []byte(fmt.Sprintf("NOTICE %v %v",
-			src.nick, resp))
-	} else if args[3] == ":VERSION" {
-		runtime.ircout <- []byte(fmt.Sprintf("NOTICE %v "+
-			":VERSION kraz %v", src.nick, version))
-	} else if strings.HasPrefix(args[3], ":&") {
+	text := irc_trailing(args, 3)
+	if cmd, params, ok := irc_parse_ctcp(text); ok {
+		irc_handle_ctcp(src, args[2], cmd, params)
+		return
+	}
+
+	if strings.HasPrefix(args[2], "#") {
+		irc_dispatch_event(ircEvent{command: "PRIVMSG", src: src, target: args[2],
+			text: text})
+	}
+
+	// Never respond to playback, the request was seen on an earlier connection
+	if runtime.playback {
+		irclog.Debugf("ignoring playback from %v", src.nick)
+		return
+	}
+
+	if strings.HasPrefix(args[3], ":&") {
 		irc_command(src, args)
 	}
 }
 
+// containsFold returns true if list contains s, ignoring case
+func containsFold(list []string, s string) bool {
+	for _, x := range list {
+		if strings.EqualFold(x, s) {
+			return true
+		}
+	}
+	return false
+}
+
+// irc_request_op asks ChanServ for operator status in channel if configured to
+func irc_request_op(channel string) {
+	if !containsFold(config.ChanServ.Op, channel) {
+		return
+	}
+	irclog.Printf("requesting operator status in %v", channel)
+	runtime.ircout <- []byte(fmt.Sprintf("PRIVMSG ChanServ :OP %v %v", channel,
+		config.Nick))
+}
+
+// irc_identified is called once services have confirmed we are identified to our
+// account, either through SASL or NickServ
+func irc_identified() {
+	if runtime.identified {
+		return
+	}
+	irclog.Print("identified to services")
+	runtime.identified = true
+	for _, x := range runtime.channel {
+		if x.joined {
+			irc_request_op(x.name)
+		}
+	}
+}
+
+// irc_nickserv_identify sends IDENTIFY to NickServ, used when SASL is not configured
+// or failed
+func irc_nickserv_identify() {
+	if config.NickServ.Password == "" || runtime.identified {
+		return
+	}
+	account := config.NickServ.Account
+	if account == "" {
+		account = config.Nick
+	}
+	irclog.Printf("identifying to NickServ as %v", account)
+	runtime.ircout <- []byte(fmt.Sprintf("PRIVMSG NickServ :IDENTIFY %v %v", account,
+		config.NickServ.Password))
+}
+
+var defaultNickServConfirm = regexp.MustCompile(
+	"(?i)(you are now identified|password accepted|you are now logged in)")
+
+func irc_handle_notice(src sourceDescriptor, args []string) {
+	if len(args) < 4 || src.isServer || !strings.EqualFold(src.nick, "NickServ") ||
+		runtime.playback {
+		return
+	}
+	text := irc_trailing(args, 3)
+	re := defaultNickServConfirm
+	if config.NickServ.confirm != nil {
+		re = config.NickServ.confirm
+	}
+	if re.MatchString(text) {
+		irc_identified()
+	}
+}
+
+// irc_sasl_failed continues registration without SASL, NickServ is used instead if a
+// password has been configured for it
+func irc_sasl_failed(reason string) {
+	irclog.Warnf("SASL authentication failed: %v", reason)
+}
+
 func irc_send_sasl_auth() {
 	out := bytes.Join([][]byte{[]byte(config.SaslUser),
 		[]byte(config.SaslUser), []byte(config.SaslPassword)}, []byte{0})
 	enc := base64.StdEncoding.EncodeToString(out)
 	runtime.ircout <- []byte(fmt.Sprintf("AUTHENTICATE %v", enc))
-	runtime.ircout <- []byte("CAP END")
 }
 
 func irc_input(buf []byte) {
-	args := strings.Split(string(buf), " ")
+	line := string(buf)
+	var tags map[string]string
+	if strings.HasPrefix(line, "@") {
+		i := strings.Index(line, " ")
+		if i == -1 {
+			irclog.Warnf("ignoring input with only tags: %v", logRedact(line))
+			return
+		}
+		tags = irc_parse_tags(line[1:i])
+		line = strings.TrimLeft(line[i:], " ")
+	}
+	irc_message_context(tags)
+
+	args := strings.Split(line, " ")
 
 	if len(args) <= 1 {
-		logger.Printf("ignoring input with insufficient arguments: %v", string(buf))
+		irclog.Warnf("ignoring input with insufficient arguments: %v", logRedact(line))
+		return
 	}
 
 	if args[0] == "PING" {
-		runtime.ircout <- bytes.Replace(buf, []byte("PING"),
-			[]byte("PONG"), 1)
+		runtime.ircout <- []byte(strings.Replace(line, "PING", "PONG", 1))
 		return
 	} else if args[0] == "AUTHENTICATE" {
 		if len(args) >= 1 && args[1] == "+" {
@@ -233,62 +516,117 @@ func irc_input(buf []byte) {
 
 	var src sourceDescriptor
 	var err error
-	if args[0][0] == ':' {
+	cmd := 0
+	if strings.HasPrefix(args[0], ":") {
 		src, err = irc_parse_source(args[0])
 		if err != nil {
-			logger.Printf("error parsing source: %v", err)
+			irclog.Warnf("error parsing source: %v", err)
 			return
 		}
+		cmd = 1
+		if v := tags["account"]; v != "" && v != "*" {
+			src.account = v
+		}
 	}
+	// Once the protocol handling below is done, the message is offered as a reply to
+	// anything waiting for one and to modules subscribed to the command
+	msg := irc_parse_message(tags, src, args, cmd)
+	defer irc_dispatch_message(msg)
+	defer irc_match_reply(msg)
 
 	switch args[1] {
 	case "001":
-		logger.Print("irc_input: registered")
+		irclog.Print("irc_input: registered")
 		runtime.registered = true
+		runtime.cap.negotiating = false
+		// Anything stamped earlier than this is playback from a bouncer, use the
+		// server's clock if it told us the time
+		runtime.registeredAt = clockNow()
+		if !runtime.msgTime.IsZero() {
+			runtime.registeredAt = runtime.msgTime
+		}
+		irc_nickserv_identify()
+	case "900":
+		// RPL_LOGGEDIN, sent following SASL and by some services on IDENTIFY
+		irc_identified()
+	case "902", "904", "905", "906", "908":
+		irc_sasl_failed(irc_trailing(args, 3))
+		irc_sasl_done()
+	case "NOTICE":
+		irc_handle_notice(src, args)
 	case "903":
-		// Indication SASL authentication was successful, if so initiate nick
-		// registration
-		go func() {
-			runtime.ircmeta <- IRC_META_NICKREGISTER
-		}()
+		// SASL authentication was successful, registration can complete
+		irc_sasl_done()
+	case "BATCH":
+		irc_handle_batch(args)
+	case "BOUNCER":
+		irc_handle_bouncer(args)
+	case "FAIL":
+		irc_handle_fail(args)
+	case "353":
+		irc_handle_names(args)
 	case "JOIN":
 		irc_handle_join(src, args)
+	case "PART":
+		irc_handle_part(src, args)
+	case "QUIT":
+		irc_handle_quit(src, args)
+	case "NICK":
+		irc_handle_nick(src, args)
+	case "TOPIC":
+		irc_handle_topic(src, args)
 	case "KICK":
 		irc_handle_kick(src, args)
 	case "PRIVMSG":
 		irc_handle_privmsg(src, args)
 	case "CAP":
-		if len(args) >= 5 && args[3] == "ACK" && args[4] == ":sasl" {
-			runtime.ircout <- []byte("AUTHENTICATE PLAIN")
+		irc_handle_cap(args)
+	}
+}
+
+// irc_shutdown runs module shutdown hooks and queues a QUIT if we are connected, the
+// result is reported to the shutdown routine
+func irc_shutdown() {
+	irclog.Print("irc_shutdown: running module shutdown hooks")
+	ok := runtime.shutdownModules()
+	if runtime.connected {
+		// The writer may be stuck on a dead connection with the queue full, QUIT is
+		// dropped rather than holding up shutdown
+		select {
+		case runtime.ircout <- []byte(fmt.Sprintf("QUIT :%v", config.QuitMessage)):
+		default:
+			irclog.Warnf("irc_shutdown: outgoing queue is full, not sending QUIT")
 		}
 	}
+	runtime.shutdown_done <- shutdownStatus{ok: ok, connected: runtime.connected}
 }
 
 func irc_meta(meta int) {
 	switch meta {
 	case IRC_META_REGISTER:
-		logger.Print("irc_meta: got registration notification, beginning registration")
-
-		// If we don't want SASL, we can just proceed to sending registration commands
-		if config.SaslUser == "" {
-			logger.Print("skipping SASL authentication")
-			go func() {
-				runtime.ircmeta <- IRC_META_NICKREGISTER
-			}()
-			return
+		irclog.Print("irc_meta: got registration notification, beginning registration")
+		runtime.connected = true
+
+		// The server password must precede everything else, bouncers use it to
+		// select the user and network
+		if config.ServerPassword != "" {
+			runtime.ircout <- []byte(fmt.Sprintf("PASS %v", config.ServerPassword))
 		}
-		logger.Print("attempting SASL authentication")
-		runtime.ircout <- []byte("CAP REQ :sasl")
-	case IRC_META_NICKREGISTER:
+
+		// Registration is held by the server until CAP END, servers without
+		// capability support ignore the LS and register us straight away
+		runtime.cap = capState{negotiating: true}
+		runtime.ircout <- []byte("CAP LS 302")
 		runtime.ircout <- []byte(fmt.Sprintf("NICK %v", config.Nick))
 		runtime.ircout <- []byte(fmt.Sprintf("USER %v @ host :%v", config.Nick,
 			config.Nick))
 	case IRC_META_RESET:
-		logger.Print("irc_meta: got reset notification, cleaning up for a new connection")
+		irclog.Print("irc_meta: got reset notification, cleaning up for a new connection")
 
 		// Signal the writer routine it should exit
 		runtime.net_writer_exit <- true
 
+		runtime.connected = false
 		runtime.resetStatus()
 		shouldReset = true
 	}
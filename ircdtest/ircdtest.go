@@ -0,0 +1,506 @@
+// Package ircdtest provides a minimal in-process IRC server for testing kraz. It
+// scripts enough of the protocol to register a client, including capability
+// negotiation, SASL PLAIN and binding to a soju style bouncer network, replies to
+// JOIN and PART, and lets tests inject arbitrary lines, kick the client and drop the
+// connection.
+package ircdtest
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"fmt"
+	"math/big"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const serverName = "ircdtest.local"
+
+// Server is a fake IRC server accepting one client at a time
+type Server struct {
+	// Addr is the host:port the server is listening on
+	Addr string
+
+	// SaslUser and SaslPassword are the credentials accepted during SASL PLAIN
+	// authentication, any other credentials result in a 904. If SaslUser is not set
+	// the server does not offer SASL and requests for it are refused.
+	SaslUser     string
+	SaslPassword string
+
+	// NickServPassword is the password NickServ accepts with IDENTIFY
+	NickServPassword string
+
+	// Password is the server password expected in PASS, if set clients that do not
+	// send it are disconnected when they register
+	Password string
+
+	// Caps are capabilities offered in CAP LS in addition to sasl, which is offered if
+	// SaslUser is set, and soju.im/bouncer-networks and batch, which are offered if
+	// Networks is set
+	Caps []string
+
+	// Nicks are users other than services present on the server, private messages to
+	// anyone else get a 401
+	Nicks []string
+
+	// Networks are the names of bouncer networks the client may bind to, their IDs
+	// are their position in the list starting at 1
+	Networks []string
+
+	// TLSConfig is the configuration used by the listener if the server was created
+	// with NewTLSServer, it includes a generated self signed certificate
+	TLSConfig *tls.Config
+
+	listener net.Listener
+	lines    chan string
+
+	mu          sync.Mutex
+	conn        net.Conn
+	nick        string
+	user        string
+	pass        string
+	registered  bool
+	negotiating bool // Registration is held until CAP END
+	caps        map[string]bool
+	bound       string
+	channels    map[string]bool
+	connections int
+	connected   chan bool
+	closed      bool
+}
+
+// NewServer starts a plain text server listening on a random local port
+func NewServer() (*Server, error) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+	return newServer(l, nil), nil
+}
+
+// NewTLSServer starts a TLS server listening on a random local port using a
+// freshly generated self signed certificate
+func NewTLSServer() (*Server, error) {
+	cert, err := selfSigned()
+	if err != nil {
+		return nil, err
+	}
+	tc := &tls.Config{Certificates: []tls.Certificate{cert}}
+	l, err := tls.Listen("tcp", "127.0.0.1:0", tc)
+	if err != nil {
+		return nil, err
+	}
+	return newServer(l, tc), nil
+}
+
+func newServer(l net.Listener, tc *tls.Config) *Server {
+	s := &Server{
+		Addr:      l.Addr().String(),
+		TLSConfig: tc,
+		listener:  l,
+		lines:     make(chan string, 1024),
+		connected: make(chan bool, 16),
+	}
+	go s.accept()
+	return s
+}
+
+func selfSigned() (tls.Certificate, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: serverName},
+		DNSNames:     []string{serverName, "localhost"},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(24 * time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, nil
+}
+
+// Close stops the listener and drops any connected client
+func (s *Server) Close() {
+	s.mu.Lock()
+	s.closed = true
+	s.mu.Unlock()
+	s.listener.Close()
+	s.Disconnect()
+}
+
+// Connections returns the number of client connections accepted so far
+func (s *Server) Connections() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.connections
+}
+
+// WaitConnected waits for the next client connection to be accepted
+func (s *Server) WaitConnected(timeout time.Duration) error {
+	select {
+	case <-s.connected:
+		return nil
+	case <-time.After(timeout):
+		return fmt.Errorf("timed out waiting for a connection")
+	}
+}
+
+// Expect waits for a line from the client beginning with prefix, discarding any
+// other lines received in the meantime
+func (s *Server) Expect(prefix string, timeout time.Duration) (string, error) {
+	deadline := time.After(timeout)
+	for {
+		select {
+		case l := <-s.lines:
+			if strings.HasPrefix(l, prefix) {
+				return l, nil
+			}
+		case <-deadline:
+			return "", fmt.Errorf("timed out waiting for %q", prefix)
+		}
+	}
+}
+
+// Send writes a raw line to the connected client
+func (s *Server) Send(line string) error {
+	s.mu.Lock()
+	conn := s.conn
+	s.mu.Unlock()
+	if conn == nil {
+		return fmt.Errorf("no client connected")
+	}
+	_, err := conn.Write([]byte(line + "\r\n"))
+	return err
+}
+
+// Sendf formats and writes a raw line to the connected client
+func (s *Server) Sendf(format string, a ...interface{}) error {
+	return s.Send(fmt.Sprintf(format, a...))
+}
+
+// Nick returns the nick the client registered with
+func (s *Server) Nick() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.nick
+}
+
+// Bound returns the name of the bouncer network the client bound to
+func (s *Server) Bound() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.bound
+}
+
+// Joined returns true if the client is currently in channel
+func (s *Server) Joined(channel string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.channels[strings.ToLower(channel)]
+}
+
+// Privmsg sends a channel or private message to the client from nick
+func (s *Server) Privmsg(nick string, target string, text string) error {
+	return s.Sendf(":%v!%v@test.host PRIVMSG %v :%v", nick, nick, target, text)
+}
+
+// Kick removes the client from channel
+func (s *Server) Kick(channel string, by string, reason string) error {
+	s.mu.Lock()
+	nick := s.nick
+	delete(s.channels, strings.ToLower(channel))
+	s.mu.Unlock()
+	return s.Sendf(":%v!%v@test.host KICK %v %v :%v", by, by, channel, nick, reason)
+}
+
+// Disconnect drops the client connection without any protocol level notice
+func (s *Server) Disconnect() {
+	s.mu.Lock()
+	conn := s.conn
+	s.conn = nil
+	s.mu.Unlock()
+	if conn != nil {
+		conn.Close()
+	}
+}
+
+func (s *Server) accept() {
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+		s.mu.Lock()
+		if s.closed {
+			s.mu.Unlock()
+			conn.Close()
+			return
+		}
+		if s.conn != nil {
+			s.conn.Close()
+		}
+		s.conn = conn
+		s.nick = ""
+		s.user = ""
+		s.pass = ""
+		s.registered = false
+		s.negotiating = false
+		s.caps = make(map[string]bool)
+		s.bound = ""
+		s.channels = make(map[string]bool)
+		s.connections++
+		s.mu.Unlock()
+		s.connected <- true
+		go s.serve(conn)
+	}
+}
+
+func (s *Server) serve(conn net.Conn) {
+	defer conn.Close()
+
+	sc := bufio.NewScanner(conn)
+	for sc.Scan() {
+		line := strings.TrimRight(sc.Text(), "\r")
+		select {
+		case s.lines <- line:
+		default:
+		}
+		if !s.handle(conn, line) {
+			return
+		}
+	}
+}
+
+func (s *Server) reply(conn net.Conn, format string, a ...interface{}) {
+	conn.Write([]byte(fmt.Sprintf(format, a...) + "\r\n"))
+}
+
+// handle scripts the server side of the protocol, returning false if the connection
+// should be closed
+func (s *Server) handle(conn net.Conn, line string) bool {
+	args := strings.Split(line, " ")
+	s.mu.Lock()
+	nick := s.nick
+	s.mu.Unlock()
+	if nick == "" {
+		nick = "*"
+	}
+
+	switch strings.ToUpper(args[0]) {
+	case "PASS":
+		if len(args) > 1 {
+			s.mu.Lock()
+			s.pass = strings.TrimPrefix(strings.Join(args[1:], " "), ":")
+			s.mu.Unlock()
+		}
+	case "CAP":
+		if len(args) < 2 {
+			return true
+		}
+		switch args[1] {
+		case "LS":
+			s.mu.Lock()
+			s.negotiating = true
+			s.mu.Unlock()
+			s.reply(conn, ":%v CAP %v LS :%v", serverName, nick,
+				strings.Join(s.offered(), " "))
+		case "REQ":
+			s.mu.Lock()
+			s.negotiating = true
+			s.mu.Unlock()
+			caps := strings.TrimPrefix(strings.Join(args[2:], " "), ":")
+			offered := make(map[string]bool)
+			for _, x := range s.offered() {
+				offered[x] = true
+			}
+			ok := true
+			for _, x := range strings.Fields(caps) {
+				ok = ok && offered[x]
+			}
+			if !ok {
+				s.reply(conn, ":%v CAP %v NAK :%v", serverName, nick, caps)
+				return true
+			}
+			s.mu.Lock()
+			for _, x := range strings.Fields(caps) {
+				s.caps[x] = true
+			}
+			s.mu.Unlock()
+			s.reply(conn, ":%v CAP %v ACK :%v", serverName, nick, caps)
+		case "END":
+			s.mu.Lock()
+			s.negotiating = false
+			s.mu.Unlock()
+			return s.register(conn)
+		}
+	case "BOUNCER":
+		if len(args) < 2 {
+			return true
+		}
+		switch args[1] {
+		case "LISTNETWORKS":
+			s.reply(conn, ":%v BATCH +networks soju.im/bouncer-networks", serverName)
+			for i, x := range s.Networks {
+				s.reply(conn, "@batch=networks :%v BOUNCER NETWORK %v name=%v;state=connected",
+					serverName, i+1, x)
+			}
+			s.reply(conn, ":%v BATCH -networks", serverName)
+		case "BIND":
+			if len(args) < 3 {
+				return true
+			}
+			id, err := strconv.Atoi(args[2])
+			if err != nil || id < 1 || id > len(s.Networks) {
+				s.reply(conn, ":%v FAIL BOUNCER INVALID_NETID BIND %v :Unknown network",
+					serverName, args[2])
+				return true
+			}
+			s.mu.Lock()
+			s.bound = s.Networks[id-1]
+			s.mu.Unlock()
+		}
+	case "AUTHENTICATE":
+		if len(args) < 2 {
+			return true
+		}
+		if args[1] == "PLAIN" {
+			s.reply(conn, "AUTHENTICATE +")
+			return true
+		}
+		buf, err := base64.StdEncoding.DecodeString(args[1])
+		parts := bytes.Split(buf, []byte{0})
+		if err != nil || len(parts) != 3 ||
+			string(parts[1]) != s.SaslUser || string(parts[2]) != s.SaslPassword {
+			s.reply(conn, ":%v 904 %v :SASL authentication failed", serverName, nick)
+			return true
+		}
+		s.reply(conn, ":%v 900 %v %v!%v@test.host %v :You are now logged in",
+			serverName, nick, nick, nick, s.SaslUser)
+		s.reply(conn, ":%v 903 %v :SASL authentication successful", serverName, nick)
+	case "NICK":
+		if len(args) < 2 {
+			return true
+		}
+		s.mu.Lock()
+		s.nick = strings.TrimPrefix(args[1], ":")
+		s.mu.Unlock()
+		return s.register(conn)
+	case "USER":
+		if len(args) < 2 {
+			return true
+		}
+		s.mu.Lock()
+		s.user = args[1]
+		s.mu.Unlock()
+		return s.register(conn)
+	case "PRIVMSG", "NOTICE":
+		if len(args) >= 2 && !strings.HasPrefix(args[1], "#") && !s.knownNick(args[1]) {
+			s.reply(conn, ":%v 401 %v %v :No such nick/channel", serverName, nick, args[1])
+			return true
+		}
+		if len(args) >= 4 && strings.EqualFold(args[1], "NickServ") &&
+			strings.EqualFold(strings.TrimPrefix(args[2], ":"), "IDENTIFY") {
+			pass := args[len(args)-1]
+			if s.NickServPassword != "" && pass == s.NickServPassword {
+				s.reply(conn, ":NickServ!NickServ@services. NOTICE %v :You are now "+
+					"identified for %v.", nick, args[len(args)-2])
+			} else {
+				s.reply(conn, ":NickServ!NickServ@services. NOTICE %v :Invalid password "+
+					"for %v.", nick, args[len(args)-2])
+			}
+		}
+	case "PING":
+		s.reply(conn, ":%v PONG %v :%v", serverName, serverName,
+			strings.TrimPrefix(strings.Join(args[1:], " "), ":"))
+	case "JOIN":
+		if len(args) < 2 {
+			return true
+		}
+		for _, c := range strings.Split(args[1], ",") {
+			s.mu.Lock()
+			s.channels[strings.ToLower(c)] = true
+			s.mu.Unlock()
+			s.reply(conn, ":%v!%v@test.host JOIN %v", nick, nick, c)
+			s.reply(conn, ":%v 353 %v = %v :@%v", serverName, nick, c, nick)
+			s.reply(conn, ":%v 366 %v %v :End of /NAMES list.", serverName, nick, c)
+		}
+	case "PART":
+		if len(args) < 2 {
+			return true
+		}
+		s.mu.Lock()
+		delete(s.channels, strings.ToLower(args[1]))
+		s.mu.Unlock()
+		s.reply(conn, ":%v!%v@test.host PART %v", nick, nick, args[1])
+	case "QUIT":
+		s.reply(conn, "ERROR :Closing Link: %v (Quit: %v)", nick,
+			strings.TrimPrefix(strings.Join(args[1:], " "), ":"))
+		return false
+	}
+	return true
+}
+
+func (s *Server) knownNick(nick string) bool {
+	if strings.EqualFold(nick, "NickServ") || strings.EqualFold(nick, "ChanServ") {
+		return true
+	}
+	for _, x := range s.Nicks {
+		if strings.EqualFold(x, nick) {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *Server) offered() []string {
+	ret := append([]string(nil), s.Caps...)
+	if s.SaslUser != "" {
+		ret = append(ret, "sasl")
+	}
+	if len(s.Networks) > 0 {
+		ret = append(ret, "batch", "soju.im/bouncer-networks")
+	}
+	return ret
+}
+
+// register completes registration once both NICK and USER have been received
+func (s *Server) register(conn net.Conn) bool {
+	s.mu.Lock()
+	nick, user, pass, registered := s.nick, s.user, s.pass, s.registered
+	negotiating := s.negotiating
+	s.mu.Unlock()
+	if nick == "" || user == "" || registered || negotiating {
+		return true
+	}
+	if s.Password != "" && pass != s.Password {
+		s.reply(conn, ":%v 464 %v :Password incorrect", serverName, nick)
+		s.reply(conn, "ERROR :Closing Link: %v (Bad Password)", nick)
+		return false
+	}
+	s.mu.Lock()
+	s.registered = true
+	s.mu.Unlock()
+	s.reply(conn, ":%v 001 %v :Welcome to the test network %v", serverName, nick, nick)
+	s.reply(conn, ":%v 005 %v CHANTYPES=# NETWORK=test :are supported by this server",
+		serverName, nick)
+	s.reply(conn, ":%v 376 %v :End of /MOTD command.", serverName, nick)
+	return true
+}
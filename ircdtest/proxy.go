@@ -0,0 +1,190 @@
+package ircdtest
+
+import (
+	"bufio"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+)
+
+// Proxy is a minimal SOCKS5 or HTTP CONNECT proxy for testing, it relays
+// connections to whatever destination the client requests
+type Proxy struct {
+	// Addr is the host:port the proxy is listening on
+	Addr string
+
+	user     string
+	pass     string
+	listener net.Listener
+
+	mu      sync.Mutex
+	targets []string
+}
+
+// NewSOCKS5Proxy starts a SOCKS5 proxy, if user is set clients must authenticate
+// with user and pass
+func NewSOCKS5Proxy(user string, pass string) (*Proxy, error) {
+	return newProxy(user, pass, (*Proxy).serveSOCKS5)
+}
+
+// NewHTTPProxy starts an HTTP CONNECT proxy, if user is set clients must provide
+// basic credentials for user and pass
+func NewHTTPProxy(user string, pass string) (*Proxy, error) {
+	return newProxy(user, pass, (*Proxy).serveHTTP)
+}
+
+func newProxy(user string, pass string, serve func(*Proxy, net.Conn)) (*Proxy, error) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+	p := &Proxy{Addr: l.Addr().String(), user: user, pass: pass, listener: l}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go serve(p, conn)
+		}
+	}()
+	return p, nil
+}
+
+// Close stops the proxy listener
+func (p *Proxy) Close() {
+	p.listener.Close()
+}
+
+// Targets returns the destinations clients have connected to through the proxy
+func (p *Proxy) Targets() []string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return append([]string(nil), p.targets...)
+}
+
+func (p *Proxy) relay(client net.Conn, rd io.Reader, target string) {
+	p.mu.Lock()
+	p.targets = append(p.targets, target)
+	p.mu.Unlock()
+
+	upstream, err := net.Dial("tcp", target)
+	if err != nil {
+		client.Close()
+		return
+	}
+	go func() {
+		io.Copy(upstream, rd)
+		upstream.Close()
+	}()
+	io.Copy(client, upstream)
+	client.Close()
+}
+
+func (p *Proxy) serveSOCKS5(conn net.Conn) {
+	fail := func() { conn.Close() }
+
+	hdr := make([]byte, 2)
+	if _, err := io.ReadFull(conn, hdr); err != nil || hdr[0] != 0x05 {
+		fail()
+		return
+	}
+	methods := make([]byte, hdr[1])
+	if _, err := io.ReadFull(conn, methods); err != nil {
+		fail()
+		return
+	}
+	want := byte(0x00)
+	if p.user != "" {
+		want = 0x02
+	}
+	found := false
+	for _, m := range methods {
+		if m == want {
+			found = true
+		}
+	}
+	if !found {
+		conn.Write([]byte{0x05, 0xff})
+		fail()
+		return
+	}
+	conn.Write([]byte{0x05, want})
+
+	if want == 0x02 {
+		b := make([]byte, 2)
+		if _, err := io.ReadFull(conn, b); err != nil {
+			fail()
+			return
+		}
+		user := make([]byte, b[1])
+		io.ReadFull(conn, user)
+		io.ReadFull(conn, b[:1])
+		pass := make([]byte, b[0])
+		io.ReadFull(conn, pass)
+		if string(user) != p.user || string(pass) != p.pass {
+			conn.Write([]byte{0x01, 0x01})
+			fail()
+			return
+		}
+		conn.Write([]byte{0x01, 0x00})
+	}
+
+	req := make([]byte, 4)
+	if _, err := io.ReadFull(conn, req); err != nil || req[1] != 0x01 {
+		fail()
+		return
+	}
+	var host string
+	switch req[3] {
+	case 0x01, 0x04:
+		n := net.IPv4len
+		if req[3] == 0x04 {
+			n = net.IPv6len
+		}
+		ip := make([]byte, n)
+		io.ReadFull(conn, ip)
+		host = net.IP(ip).String()
+	case 0x03:
+		l := make([]byte, 1)
+		io.ReadFull(conn, l)
+		name := make([]byte, l[0])
+		io.ReadFull(conn, name)
+		host = string(name)
+	default:
+		conn.Write([]byte{0x05, 0x08, 0x00, 0x01, 0, 0, 0, 0, 0, 0})
+		fail()
+		return
+	}
+	port := make([]byte, 2)
+	io.ReadFull(conn, port)
+	target := net.JoinHostPort(host, strconv.Itoa(int(binary.BigEndian.Uint16(port))))
+
+	conn.Write([]byte{0x05, 0x00, 0x00, 0x01, 0, 0, 0, 0, 0, 0})
+	p.relay(conn, conn, target)
+}
+
+func (p *Proxy) serveHTTP(conn net.Conn) {
+	r := bufio.NewReader(conn)
+	req, err := http.ReadRequest(r)
+	if err != nil || req.Method != http.MethodConnect {
+		conn.Write([]byte("HTTP/1.1 405 Method Not Allowed\r\n\r\n"))
+		conn.Close()
+		return
+	}
+	if p.user != "" {
+		want := "Basic " + base64.StdEncoding.EncodeToString([]byte(p.user+":"+p.pass))
+		if req.Header.Get("Proxy-Authorization") != want {
+			conn.Write([]byte("HTTP/1.1 407 Proxy Authentication Required\r\n\r\n"))
+			conn.Close()
+			return
+		}
+	}
+	fmt.Fprintf(conn, "HTTP/1.1 200 Connection established\r\n\r\n")
+	p.relay(conn, r, req.Host)
+}
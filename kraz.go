@@ -1,49 +1,160 @@
 package main
 
 import (
-	"crypto/tls"
 	"flag"
-	"log"
+	"fmt"
 	"os"
+	"os/signal"
+	"strings"
 	"sync"
+	"syscall"
 	"time"
 )
 
 const version = "0.0.1"
 
+// Deadline for the shutdown sequence, covering module shutdown hooks and flushing
+// anything remaining in the outgoing queue
+const shutdownTimeout = 10 * time.Second
+
+// Delay between connection attempts when no server was available
+var reconnectDelay = 5 * time.Second
+
+const (
+	EXIT_OK      = 0
+	EXIT_ERROR   = 1
+	EXIT_UNCLEAN = 2 // Shutdown completed but a module failed or the flush timed out
+)
+
 var config *cfg
+var configPath string
 var runtime kruntime
-var logger *log.Logger
+
+// configLock guards replacing config. Only the IRC handler replaces it, so the handler
+// reads it freely; other goroutines must use currentConfig.
+var configLock sync.Mutex
+
+func currentConfig() *cfg {
+	configLock.Lock()
+	defer configLock.Unlock()
+	return config
+}
 
 type channelStatus struct {
 	name      string
 	joined    bool
-	join_sent time.Time // Last time a JOIN was sent for this channel
+	join_sent time.Time       // Last time a JOIN was sent for this channel
+	members   map[string]bool // Nicks present in the channel, lower case
+}
+
+// shutdownStatus is reported by the IRC handler once module shutdown hooks have run
+type shutdownStatus struct {
+	ok        bool // All modules shut down cleanly
+	connected bool // A connection is up, the outgoing queue should be flushed
 }
 
 type kruntime struct {
-	connected bool
+	connected bool // Owned by the IRC handler, set from meta notifications
 
 	ircin    chan []byte
 	ircout   chan []byte
 	ircmeta  chan int
 	ircreset chan bool // Used to indicate the IRC handler is reset and ready
 
-	net_writer_exit chan bool
+	net_writer_exit    chan bool
+	net_writer_flush   chan time.Time // Request the writer flush the queue and exit
+	net_writer_flushed chan bool      // Result of a flush request
+
+	ircshutdown   chan bool           // Request the IRC handler run module shutdown hooks
+	shutdown_done chan shutdownStatus // Result of module shutdown
+	ircreload     chan bool           // Request the IRC handler reload the configuration
+	exiting       chan bool           // Closed when shutdown begins
+	entry_done    chan bool           // Closed when the connection routines have exited
+
+	out output // Used by modules to send to the server
+
+	fetched   chan fetchResult // Completions of background fetches, run by the IRC handler
+	fetching  int              // Background fetches that haven't completed
+	connGen   int              // Incremented each time the connection is reset
+	moduleGen int              // Incremented each time modules are replaced by a reload
+
+	registered     bool
+	identified     bool // Services have confirmed we are identified to our account
+	identifyWarned bool // Warned that channels are waiting on identification
+
+	cap          capState
+	registeredAt time.Time // Server time registration completed, to detect playback
+	msgTime      time.Time // Server time of the message being processed, if tagged
+	playback     bool      // The message being processed is bouncer playback
 
-	registered bool
+	pending   []pendingReply // Commands waiting for a reply
+	nextLabel int
 
 	channel []channelStatus
 
 	modules []module
 }
 
+// fetchResult is the completion of a background fetch, tagged with the connection and
+// the module instances it was started by
+type fetchResult struct {
+	conn    int
+	modules int
+	done    func()
+}
+
+// background runs fetch on its own goroutine so slow network requests don't hold up
+// the IRC handler. fetch must not touch module state; it returns a function that the
+// IRC handler runs with the results, which may.
+func (k *kruntime) background(fetch func() func()) {
+	k.fetching++
+	conn, modules := k.connGen, k.moduleGen
+	go func() {
+		res := fetchResult{conn: conn, modules: modules, done: fetch()}
+		select {
+		case k.fetched <- res:
+		case <-k.exiting:
+		}
+	}()
+}
+
+// fetchDone runs the completion of a background fetch. Results of fetches started on
+// a connection that has since been lost are dropped, replies to it would go to the
+// next connection, as are results for modules a reload has replaced.
+func (k *kruntime) fetchDone(res fetchResult) {
+	k.fetching--
+	if !k.registered || res.conn != k.connGen {
+		logger.Debugf("discarding background fetch started on a lost connection")
+		return
+	}
+	if res.modules != k.moduleGen {
+		logger.Debugf("discarding background fetch started by a replaced module")
+		return
+	}
+	res.done()
+}
+
 func (k *kruntime) addModule(m module) {
 	logger.Printf("registering module: %v", m.getName())
 	m.initialize()
 	k.modules = append(k.modules, m)
 }
 
+// shutdownModules calls the shutdown hook of each registered module, returning false if
+// any of them failed
+func (k *kruntime) shutdownModules() bool {
+	ret := true
+	for _, m := range k.modules {
+		logger.Printf("shutting down module: %v", m.getName())
+		err := m.shutdown()
+		if err != nil {
+			logger.Errorf("error shutting down module %v: %v", m.getName(), err)
+			ret = false
+		}
+	}
+	return ret
+}
+
 func (k *kruntime) markChannelJoined(name string, status bool) {
 	for i := range k.channel {
 		if k.channel[i].name == name {
@@ -53,12 +164,106 @@ func (k *kruntime) markChannelJoined(name string, status bool) {
 	}
 }
 
+// reconfigureChannels brings the channel list in line with a new configuration,
+// parting channels that were removed; added channels are joined by irc_periodic
+func (k *kruntime) reconfigureChannels(channels []string) {
+	want := make(map[string]bool)
+	for _, x := range channels {
+		want[x] = true
+	}
+
+	var keep []channelStatus
+	for _, x := range k.channel {
+		if want[x.name] {
+			keep = append(keep, x)
+			delete(want, x.name)
+			continue
+		}
+		logger.Printf("no longer configured for %v", x.name)
+		if x.joined {
+			k.out.part(x.name, "")
+		}
+	}
+	for _, x := range channels {
+		if !want[x] {
+			continue
+		}
+		logger.Printf("configuring for %v", x)
+		keep = append(keep, channelStatus{
+			name:   x,
+			joined: false,
+		})
+	}
+	k.channel = keep
+}
+
+func (k *kruntime) findChannel(name string) *channelStatus {
+	for i := range k.channel {
+		if strings.EqualFold(k.channel[i].name, name) {
+			return &k.channel[i]
+		}
+	}
+	return nil
+}
+
+func (k *kruntime) clearMembers(channel string) {
+	if c := k.findChannel(channel); c != nil {
+		c.members = make(map[string]bool)
+	}
+}
+
+func (k *kruntime) addMember(channel string, nick string) {
+	c := k.findChannel(channel)
+	if c == nil {
+		return
+	}
+	if c.members == nil {
+		c.members = make(map[string]bool)
+	}
+	c.members[strings.ToLower(nick)] = true
+}
+
+func (k *kruntime) removeMember(channel string, nick string) {
+	if c := k.findChannel(channel); c != nil {
+		delete(c.members, strings.ToLower(nick))
+	}
+}
+
+// removeMemberAll removes nick from every channel, returning the channels it was in
+func (k *kruntime) removeMemberAll(nick string) []string {
+	var ret []string
+	nick = strings.ToLower(nick)
+	for i := range k.channel {
+		if k.channel[i].members[nick] {
+			delete(k.channel[i].members, nick)
+			ret = append(ret, k.channel[i].name)
+		}
+	}
+	return ret
+}
+
+// renameMember handles a nick change, returning the channels the nick was in
+func (k *kruntime) renameMember(old string, new string) []string {
+	ret := k.removeMemberAll(old)
+	for _, x := range ret {
+		k.addMember(x, new)
+	}
+	return ret
+}
+
 func (k *kruntime) resetStatus() {
 	for i := range k.channel {
 		k.channel[i].joined = false
 		k.channel[i].join_sent = time.Time{}
+		k.channel[i].members = nil
 	}
 	k.registered = false
+	k.identified = false
+	k.identifyWarned = false
+	k.cap = capState{}
+	k.registeredAt = time.Time{}
+	k.pending = nil
+	k.connGen++
 }
 
 func (k *kruntime) stateInit() {
@@ -69,10 +274,21 @@ func (k *kruntime) stateInit() {
 
 	k.ircin = make(chan []byte, 512)
 	k.ircout = make(chan []byte, 512)
+	k.out = &ircOutput{r: k}
 	k.ircmeta = make(chan int) // We don't buffer meta commands
 	k.ircreset = make(chan bool)
 
 	k.net_writer_exit = make(chan bool)
+	k.net_writer_flush = make(chan time.Time)
+	k.net_writer_flushed = make(chan bool)
+
+	k.ircshutdown = make(chan bool)
+	// Buffered, shutdown may have stopped waiting
+	k.shutdown_done = make(chan shutdownStatus, 1)
+	k.ircreload = make(chan bool, 1)
+	k.fetched = make(chan fetchResult, 64)
+	k.exiting = make(chan bool)
+	k.entry_done = make(chan bool)
 
 	for _, x := range config.Channels {
 		logger.Printf("configuring for %v", x)
@@ -84,74 +300,184 @@ func (k *kruntime) stateInit() {
 	}
 }
 
-func init() {
-	logger = log.New(os.Stdout, "kraz: ", log.Ltime|log.Ldate|log.LUTC)
-}
-
-func entry(wg *sync.WaitGroup) {
-	defer func() {
-		logger.Print("main thread exiting")
-		wg.Done()
-	}()
-
+func entry() {
 	logger.Print("main thread starting")
 
 	for {
-		var conn *tls.Conn
-		var err error
-		// Check our connection status and see if we need to establish or not
-		if !runtime.connected {
-			conn, err = net_connect(config.Servers, config.VerifyCert)
-			if err != nil {
-				logger.Printf("connection error: %v: sleeping for retry", err)
-				time.Sleep(5 * time.Second)
-				continue
-			}
-			runtime.connected = true
+		select {
+		case <-runtime.exiting:
+			logger.Print("main thread exiting")
+			close(runtime.entry_done)
+			return
+		default:
+		}
+
+		conn, err := net_connect(currentConfig())
+		if err != nil {
+			logger.Warnf("connection error: %v: sleeping for retry", err)
+			time.Sleep(reconnectDelay)
+			continue
 		}
 
 		// Signal the protocol handler we have a valid connection and we want to
 		// send our registration
-		runtime.ircmeta <- IRC_META_REGISTER
+		select {
+		case runtime.ircmeta <- IRC_META_REGISTER:
+		case <-runtime.exiting:
+			conn.Close()
+			continue
+		}
 
 		var wg sync.WaitGroup
 		wg.Add(2)
 		go net_reader(&wg, conn)
 		go net_writer(&wg, conn)
 		wg.Wait()
-		runtime.connected = false
 
 		// If we get here, the network threads have exited but we want to make sure the IRC
 		// protocol handler is ready for a new connection, wait until we get a signal from it
-		<-runtime.ircreset
+		select {
+		case <-runtime.ircreset:
+		case <-runtime.exiting:
+		}
 	}
 }
 
-func execute(confpath string) {
+// shutdown runs module shutdown hooks, sends QUIT and flushes the outgoing queue,
+// returning the exit status for the process
+func shutdown() int {
+	ret := EXIT_OK
+	deadline := time.Now().Add(shutdownTimeout)
+	close(runtime.exiting)
+
+	select {
+	case runtime.ircshutdown <- true:
+	case <-time.After(time.Until(deadline)):
+		logger.Errorf("timed out waiting for irc handler, modules were not shut down")
+		return EXIT_UNCLEAN
+	}
+	var status shutdownStatus
+	select {
+	case status = <-runtime.shutdown_done:
+		if !status.ok {
+			ret = EXIT_UNCLEAN
+		}
+	case <-time.After(time.Until(deadline)):
+		logger.Errorf("timed out waiting for module shutdown hooks")
+		return EXIT_UNCLEAN
+	}
+
+	if status.connected {
+		select {
+		case runtime.net_writer_flush <- deadline:
+			if !<-runtime.net_writer_flushed {
+				ret = EXIT_UNCLEAN
+			}
+		case <-time.After(time.Until(deadline)):
+			logger.Errorf("timed out waiting for net_writer, outgoing queue was not flushed")
+			ret = EXIT_UNCLEAN
+		}
+	}
+
+	// The writer closes the connection once flushed, wait for the connection
+	// routines to notice and exit
+	select {
+	case <-runtime.entry_done:
+	case <-time.After(time.Until(deadline)):
+		logger.Errorf("timed out waiting for connection to close")
+		ret = EXIT_UNCLEAN
+	}
+
+	return ret
+}
+
+func execute(confpath string) int {
 	logger.Print("initializing")
 
 	var err error
+	configPath = confpath
 	config, err = loadCfg(confpath)
 	if err != nil {
-		log.Fatalf("error loading configuration: %v", err)
+		logger.Errorf("error loading configuration: %v", err)
+		return EXIT_ERROR
+	}
+	err = logConfigure(config.Log)
+	if err != nil {
+		logger.Errorf("error configuring logging: %v", err)
+		return EXIT_ERROR
+	}
+
+	if config.Capture != "" {
+		err = capture.open(config.Capture)
+		if err != nil {
+			logger.Errorf("error opening capture file: %v", err)
+			return EXIT_ERROR
+		}
+		logger.Printf("recording protocol capture to %v", config.Capture)
 	}
 
 	runtime.stateInit()
 
 	err = moduleRegistration()
 	if err != nil {
-		log.Fatalf("error during module registration: %v", err)
+		logger.Errorf("error during module registration: %v", err)
+		return EXIT_ERROR
+	}
+
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
+
+	go entry()
+	go irc_handler()
+
+	for {
+		s := <-sig
+		if s != syscall.SIGHUP {
+			logger.Printf("got signal %v, shutting down", s)
+			break
+		}
+		logger.Print("got SIGHUP, requesting configuration reload")
+		select {
+		case runtime.ircreload <- true:
+		default:
+			logger.Warnf("configuration reload already pending")
+		}
 	}
+	ret := shutdown()
+	logger.Printf("exiting with status %v", ret)
+	return ret
+}
 
-	var wg sync.WaitGroup
-	wg.Add(2)
-	go entry(&wg)
-	go irc_handler(&wg)
-	wg.Wait()
+// checkConfig loads the configuration at confpath and builds the modules it enables,
+// so anything that would prevent the bot starting is reported
+func checkConfig(confpath string) error {
+	c, err := loadCfg(confpath)
+	if err != nil {
+		return err
+	}
+	_, err = buildModules(c)
+	return err
 }
 
 func main() {
 	confpath := flag.String("c", "./kraz.yaml", "path to configuration")
+	checkOnly := flag.Bool("check-config", false, "validate configuration and exit")
+	replayPath := flag.String("replay", "", "replay a protocol capture and exit")
 	flag.Parse()
-	execute(*confpath)
+
+	if *replayPath != "" {
+		os.Exit(replay(*confpath, *replayPath, os.Stdout))
+	}
+
+	if *checkOnly {
+		err := checkConfig(*confpath)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%v\n", err)
+			os.Exit(EXIT_ERROR)
+		}
+		fmt.Printf("configuration %v is valid\n", *confpath)
+		os.Exit(EXIT_OK)
+	}
+
+	os.Exit(execute(*confpath))
 }
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+)
+
+func TestCheckConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kraz")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	p := path.Join(dir, "kraz.yaml")
+
+	for _, x := range []struct {
+		ticker string
+		ok     bool
+	}{
+		{"interval: 5m", true},
+		// The calendar is only read when the modules are built
+		{"interval: 5m\n  calendar: " + path.Join(dir, "missing.yaml"), false},
+	} {
+		buf := "nick: kraz\nservers: [irc.example.com:6697]\n" +
+			"ticker:\n  channel: \"#test\"\n  symbols: [AAPL]\n  " + x.ticker + "\n"
+		if err := ioutil.WriteFile(p, []byte(buf), 0600); err != nil {
+			t.Fatal(err)
+		}
+		err := checkConfig(p)
+		if x.ok && err != nil {
+			t.Errorf("%q: %v", x.ticker, err)
+		} else if !x.ok && err == nil {
+			t.Errorf("%q: configuration accepted", x.ticker)
+		}
+	}
+}
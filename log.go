@@ -0,0 +1,293 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+type logLevel int
+
+const (
+	LOG_DEBUG logLevel = iota
+	LOG_INFO
+	LOG_WARN
+	LOG_ERROR
+)
+
+var logLevelNames = map[logLevel]string{
+	LOG_DEBUG: "debug",
+	LOG_INFO:  "info",
+	LOG_WARN:  "warn",
+	LOG_ERROR: "error",
+}
+
+func parseLogLevel(s string) (logLevel, error) {
+	for k, v := range logLevelNames {
+		if v == strings.ToLower(s) {
+			return k, nil
+		}
+	}
+	return LOG_INFO, fmt.Errorf("unknown log level %q", s)
+}
+
+// klog is a logger for a single subsystem, such as net, irc or module:ticker. Print
+// and Printf log at info level.
+type klog struct {
+	subsystem string
+}
+
+func newLogger(subsystem string) *klog {
+	return &klog{subsystem: subsystem}
+}
+
+// Subsystem loggers; modules create their own using a module: prefix
+var logger = newLogger("kraz")
+var netlog = newLogger("net")
+var irclog = newLogger("irc")
+
+// logState holds the active logging configuration, shared by every klog
+type logState struct {
+	sync.Mutex
+
+	level    logLevel
+	levels   map[string]logLevel
+	json     bool
+	out      io.Writer
+	outs     map[string]io.Writer // Per subsystem destinations
+	files    []*os.File           // Opened files, closed on reconfiguration
+	redactpm bool
+}
+
+var logs = logState{
+	level:    LOG_INFO,
+	out:      os.Stdout,
+	redactpm: true,
+}
+
+// logConfigure applies a log configuration, opening any destination files. On error
+// the existing configuration remains in place.
+func logConfigure(c logCfg) error {
+	level := LOG_INFO
+	var err error
+	if c.Level != "" {
+		level, err = parseLogLevel(c.Level)
+		if err != nil {
+			return err
+		}
+	}
+	levels := make(map[string]logLevel)
+	for k, v := range c.Levels {
+		levels[k], err = parseLogLevel(v)
+		if err != nil {
+			return err
+		}
+	}
+
+	var files []*os.File
+	open := func(p string) (io.Writer, error) {
+		fd, err := os.OpenFile(p, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+		if err != nil {
+			return nil, err
+		}
+		files = append(files, fd)
+		return fd, nil
+	}
+	closeAll := func() {
+		for _, x := range files {
+			x.Close()
+		}
+	}
+
+	var out io.Writer = os.Stdout
+	if c.File != "" {
+		out, err = open(c.File)
+		if err != nil {
+			closeAll()
+			return err
+		}
+	}
+	outs := make(map[string]io.Writer)
+	for k, v := range c.Files {
+		outs[k], err = open(v)
+		if err != nil {
+			closeAll()
+			return err
+		}
+	}
+
+	logs.Lock()
+	old := logs.files
+	logs.level = level
+	logs.levels = levels
+	logs.json = c.Format == "json"
+	logs.out = out
+	logs.outs = outs
+	logs.files = files
+	logs.redactpm = !c.PrivateMessages
+	logs.Unlock()
+
+	for _, x := range old {
+		x.Close()
+	}
+	return nil
+}
+
+// lookup returns the level and destination for a subsystem. An exact match is
+// preferred, otherwise a subsystem such as module:ticker falls back to module.
+func (s *logState) lookup(subsystem string) (logLevel, io.Writer) {
+	level := s.level
+	out := s.out
+
+	base := strings.SplitN(subsystem, ":", 2)[0]
+	if v, ok := s.levels[subsystem]; ok {
+		level = v
+	} else if v, ok := s.levels[base]; ok {
+		level = v
+	}
+	if v, ok := s.outs[subsystem]; ok {
+		out = v
+	} else if v, ok := s.outs[base]; ok {
+		out = v
+	}
+	return level, out
+}
+
+func (l *klog) enabled(level logLevel) bool {
+	logs.Lock()
+	defer logs.Unlock()
+	min, _ := logs.lookup(l.subsystem)
+	return level >= min
+}
+
+func (l *klog) output(level logLevel, msg string) {
+	logs.Lock()
+	defer logs.Unlock()
+
+	min, out := logs.lookup(l.subsystem)
+	if level < min {
+		return
+	}
+
+	ts := time.Now().UTC().Format(time.RFC3339)
+	var line string
+	if logs.json {
+		buf, _ := json.Marshal(struct {
+			Time      string `json:"time"`
+			Level     string `json:"level"`
+			Subsystem string `json:"subsystem"`
+			Message   string `json:"msg"`
+		}{ts, logLevelNames[level], l.subsystem, msg})
+		line = string(buf) + "\n"
+	} else {
+		line = fmt.Sprintf("%v %-5v [%v] %v\n", ts,
+			strings.ToUpper(logLevelNames[level]), l.subsystem, msg)
+	}
+	io.WriteString(out, line)
+}
+
+func (l *klog) Debugf(format string, v ...interface{}) {
+	l.output(LOG_DEBUG, fmt.Sprintf(format, v...))
+}
+
+func (l *klog) Infof(format string, v ...interface{}) {
+	l.output(LOG_INFO, fmt.Sprintf(format, v...))
+}
+
+func (l *klog) Warnf(format string, v ...interface{}) {
+	l.output(LOG_WARN, fmt.Sprintf(format, v...))
+}
+
+func (l *klog) Errorf(format string, v ...interface{}) {
+	l.output(LOG_ERROR, fmt.Sprintf(format, v...))
+}
+
+func (l *klog) Print(v ...interface{}) {
+	l.output(LOG_INFO, fmt.Sprint(v...))
+}
+
+func (l *klog) Printf(format string, v ...interface{}) {
+	l.output(LOG_INFO, fmt.Sprintf(format, v...))
+}
+
+// logSplitLine splits a raw protocol line into arguments, returning the index of the
+// command which follows the source if one is present. Message tags are dropped.
+func logSplitLine(s string) ([]string, int) {
+	if strings.HasPrefix(s, "@") {
+		if i := strings.Index(s, " "); i != -1 {
+			s = s[i+1:]
+		}
+	}
+	args := strings.Split(s, " ")
+	cmd := 0
+	if len(args) > 0 && strings.HasPrefix(args[0], ":") {
+		cmd = 1
+	}
+	return args, cmd
+}
+
+// logRedactCredentials returns a raw protocol line with any credentials removed
+func logRedactCredentials(s string) string {
+	args, cmd := logSplitLine(s)
+	if len(args) <= cmd+1 {
+		return s
+	}
+	prefix := strings.Join(args[:cmd+2], " ")
+
+	switch strings.ToUpper(args[cmd]) {
+	case "AUTHENTICATE":
+		if args[cmd+1] != "PLAIN" && args[cmd+1] != "+" && args[cmd+1] != "*" {
+			return strings.Join(args[:cmd+1], " ") + " <redacted>"
+		}
+	case "PASS":
+		return strings.Join(args[:cmd+1], " ") + " <redacted>"
+	case "PRIVMSG", "NOTICE":
+		if len(args) <= cmd+2 {
+			return s
+		}
+		text := strings.ToUpper(strings.TrimPrefix(args[cmd+2], ":"))
+		if strings.EqualFold(args[cmd+1], "NickServ") &&
+			(text == "IDENTIFY" || text == "REGISTER" || text == "GHOST") {
+			return prefix + " :" + text + " <redacted>"
+		}
+	case "NS", "NICKSERV":
+		text := strings.ToUpper(args[cmd+1])
+		if text == "IDENTIFY" || text == "REGISTER" || text == "GHOST" {
+			return prefix + " <redacted>"
+		}
+	}
+	return s
+}
+
+// logRedact returns a raw protocol line in a form suitable for logging, with
+// credentials and optionally the contents of private messages removed
+func logRedact(s string) string {
+	r := logRedactCredentials(s)
+	if r != s {
+		return r
+	}
+
+	logs.Lock()
+	redactpm := logs.redactpm
+	logs.Unlock()
+	if !redactpm {
+		return s
+	}
+
+	args, cmd := logSplitLine(s)
+	if len(args) <= cmd+2 {
+		return s
+	}
+	switch strings.ToUpper(args[cmd]) {
+	case "PRIVMSG", "NOTICE":
+		target := args[cmd+1]
+		if !strings.HasPrefix(target, "#") && !strings.HasPrefix(target, "&") {
+			return strings.Join(args[:cmd+2], " ") + " :<private message redacted>"
+		}
+	}
+	return s
+}
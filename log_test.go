@@ -0,0 +1,43 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestLogRedact(t *testing.T) {
+	defer func() { logs.redactpm = true }()
+
+	for _, x := range []struct {
+		line     string
+		redactpm bool
+		want     string
+	}{
+		{"AUTHENTICATE PLAIN", true, "AUTHENTICATE PLAIN"},
+		{"AUTHENTICATE +", true, "AUTHENTICATE +"},
+		{"AUTHENTICATE a3JhegBrcmF6AHNlY3JldA==", false, "AUTHENTICATE <redacted>"},
+		{"PASS secret", false, "PASS <redacted>"},
+		{"PASS user/network:secret", false, "PASS <redacted>"},
+		{"PRIVMSG NickServ :IDENTIFY acct pw", false, "PRIVMSG NickServ :IDENTIFY <redacted>"},
+		{"PRIVMSG NickServ :identify pw", false, "PRIVMSG NickServ :IDENTIFY <redacted>"},
+		{"PRIVMSG nickserv :Register pw kraz@example.com", false,
+			"PRIVMSG nickserv :REGISTER <redacted>"},
+		{"PRIVMSG NickServ :GHOST kraz pw", false, "PRIVMSG NickServ :GHOST <redacted>"},
+		{"PRIVMSG NickServ :INFO kraz", false, "PRIVMSG NickServ :INFO kraz"},
+		{"NICKSERV IDENTIFY acct pw", false, "NICKSERV IDENTIFY <redacted>"},
+		{"ns identify pw", false, "ns identify <redacted>"},
+		{"NS GHOST kraz pw", false, "NS GHOST <redacted>"},
+		{"@time=2026-01-01T00:00:00Z :alice!a@h PRIVMSG kraz :hello there", true,
+			":alice!a@h PRIVMSG kraz :<private message redacted>"},
+		{":alice!a@h NOTICE kraz :hello", true,
+			":alice!a@h NOTICE kraz :<private message redacted>"},
+		{":alice!a@h PRIVMSG kraz :hello", false, ":alice!a@h PRIVMSG kraz :hello"},
+		{":alice!a@h PRIVMSG #test :hello", true, ":alice!a@h PRIVMSG #test :hello"},
+		{":alice!a@h PRIVMSG &local :hello", true, ":alice!a@h PRIVMSG &local :hello"},
+		{"PING :irc.example.com", true, "PING :irc.example.com"},
+	} {
+		logs.redactpm = x.redactpm
+		if got := logRedact(x.line); got != x.want {
+			t.Errorf("%q: got %q, wanted %q", x.line, got, x.want)
+		}
+	}
+}
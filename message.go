@@ -0,0 +1,175 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// How long a reply to a command sent with sendWithReply is waited for
+var replyTimeout = 30 * time.Second
+
+// ircMessage is a parsed protocol line, delivered to modules implementing
+// messageModule and to reply callbacks
+type ircMessage struct {
+	tags     map[string]string
+	src      sourceDescriptor
+	command  string   // Command, or a three digit numeric
+	params   []string // Parameters, the trailing parameter without its leading :
+	time     time.Time
+	playback bool
+}
+
+// isNumeric returns true if the message is a numeric reply
+func (m *ircMessage) isNumeric() bool {
+	if len(m.command) != 3 {
+		return false
+	}
+	for _, c := range m.command {
+		if c < '0' || c > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+// isError returns true for numerics in the error range (400 to 599)
+func (m *ircMessage) isError() bool {
+	return m.isNumeric() && m.command[0] >= '4' && m.command[0] <= '5'
+}
+
+// subject returns the nick or channel a numeric concerns, the parameter following our
+// own nick, for example the nick that doesn't exist in a 401
+func (m *ircMessage) subject() string {
+	if !m.isNumeric() || len(m.params) < 3 {
+		return ""
+	}
+	return m.params[1]
+}
+
+// trailing returns the last parameter, usually the human readable text
+func (m *ircMessage) trailing() string {
+	if len(m.params) == 0 {
+		return ""
+	}
+	return m.params[len(m.params)-1]
+}
+
+// irc_parse_message builds an ircMessage from a split line, args[i] is the command
+func irc_parse_message(tags map[string]string, src sourceDescriptor, args []string,
+	i int) ircMessage {
+	ret := ircMessage{
+		tags:     tags,
+		src:      src,
+		command:  strings.ToUpper(args[i]),
+		time:     runtime.msgTime,
+		playback: runtime.playback,
+	}
+	if ret.time.IsZero() {
+		ret.time = clockNow()
+	}
+	for j := i + 1; j < len(args); j++ {
+		if strings.HasPrefix(args[j], ":") {
+			ret.params = append(ret.params, irc_trailing(args, j))
+			break
+		}
+		if args[j] != "" {
+			ret.params = append(ret.params, args[j])
+		}
+	}
+	return ret
+}
+
+// pendingReply is a command waiting for a reply. With labeled-response the server tags
+// every reply with our label, otherwise the first numeric about subject is taken to be
+// the reply.
+type pendingReply struct {
+	label   string
+	subject string
+	batch   string // Reference of the labeled-response batch holding the replies
+	cb      func(ircMessage)
+	expires time.Time
+}
+
+// sendWithReply sends a command through the output given to send, calling cb with
+// the server's reply about subject. Commands that succeed silently, such as a PRIVMSG,
+// only produce a reply if the server supports labeled-response, in which case cb
+// receives an ACK. Nothing is waited for if send returns an error.
+func (k *kruntime) sendWithReply(subject string, send func(output) error,
+	cb func(ircMessage)) error {
+	p := pendingReply{subject: subject, cb: cb, expires: clockNow().Add(replyTimeout)}
+	out := k.out
+	if k.cap.enabled["labeled-response"] {
+		k.nextLabel++
+		p.label = fmt.Sprintf("kraz%v", k.nextLabel)
+		out = out.labeled(p.label)
+	}
+	err := send(out)
+	if err != nil {
+		return err
+	}
+	k.pending = append(k.pending, p)
+	return nil
+}
+
+func (p *pendingReply) matches(msg ircMessage) bool {
+	if p.label == "" {
+		return msg.subject() != "" && strings.EqualFold(msg.subject(), p.subject)
+	}
+	if msg.tags["label"] == p.label {
+		return true
+	}
+	if p.batch == "" {
+		return false
+	}
+	return msg.tags["batch"] == p.batch ||
+		(msg.command == "BATCH" && len(msg.params) > 0 && msg.params[0] == "-"+p.batch)
+}
+
+// irc_match_reply passes msg to the callback of the command it is a reply to, if any
+func irc_match_reply(msg ircMessage) {
+	now := clockNow()
+	n := 0
+	for _, p := range runtime.pending {
+		if now.Before(p.expires) {
+			runtime.pending[n] = p
+			n++
+		}
+	}
+	runtime.pending = runtime.pending[:n]
+	if msg.playback {
+		return
+	}
+
+	for i := range runtime.pending {
+		p := &runtime.pending[i]
+		if !p.matches(msg) {
+			continue
+		}
+		cb := p.cb
+		isBatch := msg.command == "BATCH" && len(msg.params) > 0
+		switch {
+		case isBatch && strings.HasPrefix(msg.params[0], "+"):
+			// The replies follow in a labeled-response batch
+			p.batch = msg.params[0][1:]
+		case isBatch:
+			runtime.pending = append(runtime.pending[:i], runtime.pending[i+1:]...)
+		case p.batch != "":
+			cb(msg)
+		default:
+			runtime.pending = append(runtime.pending[:i], runtime.pending[i+1:]...)
+			cb(msg)
+		}
+		return
+	}
+}
+
+// irc_dispatch_message delivers msg to modules implementing messageModule that handle
+// its command
+func irc_dispatch_message(msg ircMessage) {
+	for _, m := range runtime.modules {
+		if e, ok := m.(messageModule); ok && e.handlesMessage(msg.command) {
+			e.handleMessage(msg, &runtime)
+		}
+	}
+}
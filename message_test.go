@@ -0,0 +1,39 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestLabeledReply(t *testing.T) {
+	config = &cfg{Nick: "kraz"}
+	runtime = kruntime{}
+	runtime.stateInit()
+	runtime.cap.enabled = map[string]bool{"labeled-response": true}
+
+	var got []string
+	runtime.sendWithReply("bob", func(out output) error {
+		return out.privmsg("bob", "hello\r\nQUIT")
+	}, func(msg ircMessage) {
+		got = append(got, msg.command)
+	})
+	if l := string(<-runtime.ircout); l != "@label=kraz1 PRIVMSG bob :hello QUIT" {
+		t.Fatalf("unexpected line %q", l)
+	}
+
+	for _, l := range []string{
+		// Unlabeled replies about the same nick belong to something else
+		":srv 401 kraz bob :No such nick/channel",
+		"@label=kraz1 :srv BATCH +w labeled-response",
+		"@batch=w :srv 301 kraz bob :Gone fishing",
+		"@batch=w :srv 401 kraz bob :No such nick/channel",
+		":srv BATCH -w",
+	} {
+		irc_input([]byte(l))
+	}
+	if len(got) != 2 || got[0] != "301" || got[1] != "401" {
+		t.Fatalf("unexpected replies %v", got)
+	}
+	if len(runtime.pending) != 0 {
+		t.Fatalf("reply still pending")
+	}
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"strings"
 	"time"
 )
 
@@ -10,35 +11,148 @@ type module interface {
 	shouldRunOnJoin(string) bool
 	execute(*kruntime) error
 	initialize()
+	shutdown() error
 	handlesCommand(string) bool
 	handleCommand(sourceDescriptor, string, []string, *kruntime)
 }
 
-func moduleRegistration() error {
+// eventModule is implemented by modules that want to observe channel activity in
+// addition to commands
+type eventModule interface {
+	handleEvent(ircEvent, *kruntime)
+}
+
+// messageModule is implemented by modules that want raw messages from the server,
+// such as NOTICEs or numerics like 401 (no such nick). handlesMessage is given the
+// command or numeric.
+type messageModule interface {
+	handlesMessage(string) bool
+	handleMessage(ircMessage, *kruntime)
+}
+
+// queryModule is implemented by modules that accept some of their commands in a
+// private message as well as in a channel
+type queryModule interface {
+	handlesQuery(string) bool
+}
+
+// buildModules instantiates the modules enabled in c without initializing them, so
+// a configuration can be checked before anything in the runtime is replaced
+func buildModules(c *cfg) ([]module, error) {
+	var ret []module
 	var err error
 
-	if config.Ticker.Interval != "" {
+	if c.Ticker.Interval != "" {
 		t := ticker{}
-		t.symbols = config.Ticker.Symbols
-		t.channel = config.Ticker.Channel
-		t.interval, err = time.ParseDuration(config.Ticker.Interval)
+		for _, x := range c.Ticker.Symbols {
+			t.symbols = append(t.symbols, strings.ToUpper(x))
+		}
+		t.channel = c.Ticker.Channel
+		t.interval, err = time.ParseDuration(c.Ticker.Interval)
 		if err != nil {
-			return err
+			return nil, err
+		}
+		t.executeOnJoin = c.Ticker.ExecuteOnJoin
+		if c.Ticker.Calendar != "" {
+			t.calendar, err = loadCalendar(c.Ticker.Calendar)
+			if err != nil {
+				return nil, err
+			}
+			t.extended = c.Ticker.Sessions == "extended"
+			if c.Ticker.Reports.Open || c.Ticker.Reports.Close {
+				t.reports, err = newTickerReports(c.Ticker.Reports, t.calendar)
+				if err != nil {
+					return nil, err
+				}
+			}
+		}
+		t.cacheTTL = time.Minute
+		if c.Ticker.CacheTTL != "" {
+			t.cacheTTL, err = time.ParseDuration(c.Ticker.CacheTTL)
+			if err != nil {
+				return nil, err
+			}
+		}
+		t.workers = c.Ticker.Workers
+		if t.workers == 0 {
+			t.workers = 4
+		}
+		t.providers, err = newQuoteProviders(c.Ticker.Providers, c.Http)
+		if err != nil {
+			return nil, err
+		}
+		t.layout = tickerLayout{style: c.Ticker.Layout, color: c.Ticker.Color}
+		t.layouts = make(map[string]tickerLayout)
+		for k, v := range c.Ticker.Layouts {
+			l := t.layout
+			if v.Layout != "" {
+				l.style = v.Layout
+			}
+			if v.Color != nil {
+				l.color = *v.Color
+			}
+			t.layouts[strings.ToLower(k)] = l
 		}
-		t.executeOnJoin = config.Ticker.ExecuteOnJoin
-		runtime.addModule(&t)
+		ret = append(ret, &t)
+
+		// Alerts share the ticker's quote providers but are checked on their own
+		// schedule
+		a := alert{providers: t.providers, workers: t.workers}
+		a.interval = 5 * time.Minute
+		if c.Ticker.Alerts.Interval != "" {
+			a.interval, err = time.ParseDuration(c.Ticker.Alerts.Interval)
+			if err != nil {
+				return nil, err
+			}
+		}
+		a.hysteresis = 1
+		if c.Ticker.Alerts.Hysteresis != nil {
+			a.hysteresis = *c.Ticker.Alerts.Hysteresis
+		}
+		a.max = c.Ticker.Alerts.Max
+		if a.max == 0 {
+			a.max = 10
+		}
+		ret = append(ret, &a)
+
+		p := portfolio{providers: t.providers, workers: t.workers, cacheTTL: t.cacheTTL}
+		ret = append(ret, &p)
+
+		ret = append(ret, &history{providers: t.providers})
 	}
 
-	if config.Writer.Interval != "" {
+	if c.Writer.Interval != "" {
 		t := writer{}
-		t.channel = config.Writer.Channel
-		t.datapath = config.Writer.Datapath
-		t.interval, err = time.ParseDuration(config.Writer.Interval)
+		t.channel = c.Writer.Channel
+		t.datapath = c.Writer.Datapath
+		t.interval, err = time.ParseDuration(c.Writer.Interval)
 		if err != nil {
-			return err
+			return nil, err
 		}
-		runtime.addModule(&t)
+		ret = append(ret, &t)
 	}
 
+	if c.Chanlog.Datapath != "" {
+		t := chanlog{}
+		t.datapath = c.Chanlog.Datapath
+		t.json = c.Chanlog.Format == "json"
+		t.channels = c.Chanlog.Channels
+		t.compressAfter = c.Chanlog.CompressAfter
+		t.grepDays = c.Chanlog.GrepDays
+		t.grepMax = c.Chanlog.GrepMax
+		ret = append(ret, &t)
+	}
+
+	return ret, nil
+}
+
+func moduleRegistration() error {
+	mods, err := buildModules(config)
+	if err != nil {
+		return err
+	}
+	for _, m := range mods {
+		runtime.addModule(m)
+	}
 	return nil
 }
@@ -2,36 +2,212 @@ package main
 
 import (
 	"bytes"
+	"crypto/sha256"
 	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
 	"fmt"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"strings"
 	"sync"
 	"time"
 )
 
-func net_connect(servers []string, verify bool) (*tls.Conn, error) {
-	var ret *tls.Conn
-	var err error
+// Minimum time between writes to the server
+var writeInterval = 1 * time.Second
 
+// serverAddr is a parsed server entry from the configuration
+type serverAddr struct {
+	addr string // host:port
+	tls  bool
+}
+
+func (s serverAddr) String() string {
+	if s.tls {
+		return "ircs://" + s.addr
+	}
+	return "irc://" + s.addr
+}
+
+// net_parse_server parses a server entry, either ircs://host[:port] or
+// irc://host[:port], or a bare host:port which is treated as TLS
+func net_parse_server(s string) (serverAddr, error) {
+	var ret serverAddr
+
+	if !strings.Contains(s, "://") {
+		_, _, err := net.SplitHostPort(s)
+		if err != nil {
+			return ret, err
+		}
+		ret.addr = s
+		ret.tls = true
+		return ret, nil
+	}
+
+	u, err := url.Parse(s)
+	if err != nil {
+		return ret, err
+	}
+	port := u.Port()
+	switch u.Scheme {
+	case "ircs":
+		ret.tls = true
+		if port == "" {
+			port = "6697"
+		}
+	case "irc":
+		if port == "" {
+			port = "6667"
+		}
+	default:
+		return ret, fmt.Errorf("unknown scheme %q, must be irc or ircs", u.Scheme)
+	}
+	if u.Hostname() == "" {
+		return ret, fmt.Errorf("no host in %q", s)
+	}
+	if u.Path != "" && u.Path != "/" {
+		return ret, fmt.Errorf("unexpected path in %q", s)
+	}
+	ret.addr = net.JoinHostPort(u.Hostname(), port)
+	return ret, nil
+}
+
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+func net_tls_version_name(v uint16) string {
+	for k, x := range tlsVersions {
+		if x == v {
+			return "TLS " + k
+		}
+	}
+	return fmt.Sprintf("unknown (0x%04x)", v)
+}
+
+// net_parse_fingerprint normalizes a SHA-256 certificate fingerprint, accepting hex
+// with or without colon separators
+func net_parse_fingerprint(s string) (string, error) {
+	f := strings.ToLower(strings.Replace(s, ":", "", -1))
+	buf, err := hex.DecodeString(f)
+	if err != nil || len(buf) != sha256.Size {
+		return "", fmt.Errorf("%q is not a SHA-256 fingerprint", s)
+	}
+	return f, nil
+}
+
+// net_tls_config builds the TLS configuration for connecting to host
+func net_tls_config(c *cfg, host string) (*tls.Config, error) {
 	tlsconf := &tls.Config{
+		ServerName:         host,
 		InsecureSkipVerify: false,
 	}
-	if !verify {
+	if !c.VerifyCert {
+		tlsconf.InsecureSkipVerify = true
+	}
+
+	if c.TLS.MinVersion != "" {
+		v, ok := tlsVersions[c.TLS.MinVersion]
+		if !ok {
+			return nil, fmt.Errorf("unknown TLS version %v", c.TLS.MinVersion)
+		}
+		tlsconf.MinVersion = v
+	}
+
+	if c.TLS.CAFile != "" {
+		buf, err := ioutil.ReadFile(c.TLS.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(buf) {
+			return nil, fmt.Errorf("no certificates found in %v", c.TLS.CAFile)
+		}
+		tlsconf.RootCAs = pool
+	}
+
+	// If fingerprints are configured the server certificate is pinned, chain
+	// verification is replaced with a comparison against the fingerprints so self
+	// signed certificates can be used without disabling verification entirely
+	if len(c.TLS.Fingerprints) > 0 {
+		pins := make(map[string]bool)
+		for _, x := range c.TLS.Fingerprints {
+			f, err := net_parse_fingerprint(x)
+			if err != nil {
+				return nil, err
+			}
+			pins[f] = true
+		}
 		tlsconf.InsecureSkipVerify = true
+		tlsconf.VerifyPeerCertificate = func(raw [][]byte, _ [][]*x509.Certificate) error {
+			if len(raw) == 0 {
+				return fmt.Errorf("server presented no certificate")
+			}
+			sum := sha256.Sum256(raw[0])
+			f := hex.EncodeToString(sum[:])
+			if !pins[f] {
+				return fmt.Errorf("certificate fingerprint %v is not pinned", f)
+			}
+			return nil
+		}
+	}
+
+	return tlsconf, nil
+}
+
+func net_dial(c *cfg, s serverAddr) (net.Conn, error) {
+	raw, err := net_dial_tcp(c, s.addr)
+	if err != nil || !s.tls {
+		return raw, err
 	}
 
-	for _, s := range servers {
-		logger.Printf("attempting connection to %v", s)
+	host, _, err := net.SplitHostPort(s.addr)
+	if err != nil {
+		raw.Close()
+		return nil, err
+	}
+	tlsconf, err := net_tls_config(c, host)
+	if err != nil {
+		raw.Close()
+		return nil, err
+	}
+	conn := tls.Client(raw, tlsconf)
+	conn.SetDeadline(time.Now().Add(dialTimeout))
+	err = conn.Handshake()
+	if err != nil {
+		raw.Close()
+		return nil, err
+	}
+	conn.SetDeadline(time.Time{})
+	cs := conn.ConnectionState()
+	netlog.Printf("negotiated %v with %v", net_tls_version_name(cs.Version),
+		tls.CipherSuiteName(cs.CipherSuite))
+	return conn, nil
+}
+
+func net_connect(c *cfg) (net.Conn, error) {
+	for _, x := range c.Servers {
+		s, err := net_parse_server(x)
+		if err != nil {
+			netlog.Warnf("skipping server %v: %v", x, err)
+			continue
+		}
+		netlog.Printf("attempting connection to %v", s)
 
-		ret, err = tls.Dial("tcp", s, tlsconf)
+		conn, err := net_dial(c, s)
 		if err == nil {
-			logger.Printf("connection established to %v", s)
-			cs := ret.ConnectionState()
-			logger.Printf("cipher_suite: %v", cs.CipherSuite)
-			return ret, nil
+			netlog.Printf("connection established to %v", s)
+			capture.record(CAPTURE_META, "connected "+s.String())
+			return conn, nil
 		}
-		logger.Printf("error connecting to %v: %v", s, err)
+		netlog.Warnf("error connecting to %v: %v", s, err)
 	}
-	return ret, fmt.Errorf("no servers were available")
+	return nil, fmt.Errorf("no servers were available")
 }
 
 func net_dispatch_available(store *bytes.Buffer) {
@@ -42,16 +218,19 @@ func net_dispatch_available(store *bytes.Buffer) {
 		}
 		b := bytes.Trim(store.Next(idx+1), "\r\n")
 		// Dispatch the incoming command to the protocol handler
-		logger.Printf("net_reader: server: %v", string(b))
+		if netlog.enabled(LOG_DEBUG) {
+			netlog.Debugf("net_reader: server: %v", logRedact(string(b)))
+		}
+		capture.record(CAPTURE_IN, string(b))
 		s := make([]byte, len(b))
 		copy(s, b)
 		runtime.ircin <- s
 	}
 }
 
-func net_reader(wg *sync.WaitGroup, conn *tls.Conn) {
+func net_reader(wg *sync.WaitGroup, conn net.Conn) {
 	defer func() {
-		logger.Print("net_reader exiting")
+		netlog.Debugf("net_reader exiting")
 		wg.Done()
 	}()
 
@@ -65,15 +244,22 @@ func net_reader(wg *sync.WaitGroup, conn *tls.Conn) {
 			store.Write(buf[:n])
 		}
 		if err != nil {
-			logger.Printf("read error: %v", err)
+			netlog.Warnf("read error: %v", err)
 			// If a read error has occurred, treat it as fatal and dispatch a meta
 			// notification to the protocol handler. Also dispatch any remaining data
 			// we have in the store buffer.
-			runtime.ircmeta <- IRC_META_RESET
+			capture.record(CAPTURE_META, "disconnected")
+			select {
+			case runtime.ircmeta <- IRC_META_RESET:
+			case <-runtime.exiting:
+				// Shutting down, the protocol handler is no longer running
+				conn.Close()
+				return
+			}
 			net_dispatch_available(&store)
 			err = conn.Close()
 			if err != nil {
-				logger.Printf("error closing connection: %v", err)
+				netlog.Warnf("error closing connection: %v", err)
 			}
 			return
 		}
@@ -82,9 +268,9 @@ func net_reader(wg *sync.WaitGroup, conn *tls.Conn) {
 	}
 }
 
-func net_writer(wg *sync.WaitGroup, conn *tls.Conn) {
+func net_writer(wg *sync.WaitGroup, conn net.Conn) {
 	defer func() {
-		logger.Print("net_writer exiting")
+		netlog.Debugf("net_writer exiting")
 		wg.Done()
 	}()
 
@@ -92,18 +278,55 @@ func net_writer(wg *sync.WaitGroup, conn *tls.Conn) {
 	for {
 		select {
 		case buf := <-runtime.ircout:
-			logger.Printf("net_writer: server: %v", string(buf))
-			if !lastWrite.IsZero() && time.Now().Before(lastWrite.Add(1*time.Second)) {
-				time.Sleep(1 * time.Second)
+			if netlog.enabled(LOG_DEBUG) {
+				netlog.Debugf("net_writer: server: %v", logRedact(string(buf)))
+			}
+			if !lastWrite.IsZero() && time.Now().Before(lastWrite.Add(writeInterval)) {
+				time.Sleep(writeInterval)
 			}
 			lastWrite = time.Now()
+			capture.record(CAPTURE_OUT, string(buf))
 			_, err := conn.Write(append(buf, []byte{'\r', '\n'}...))
 			if err != nil {
-				logger.Printf("write error: %v", err)
+				netlog.Warnf("write error: %v", err)
 			}
 		case <-runtime.net_writer_exit:
-			logger.Print("net_writer got signal to exit")
+			netlog.Debugf("net_writer got signal to exit")
+			return
+		case deadline := <-runtime.net_writer_flush:
+			netlog.Debugf("net_writer got signal to flush and exit")
+			runtime.net_writer_flushed <- net_writer_drain(conn, deadline)
+			conn.Close()
 			return
 		}
 	}
 }
+
+// net_writer_drain writes anything remaining in the outgoing queue without rate
+// limiting, giving up if the deadline passes. Returns true if the queue was emptied.
+func net_writer_drain(conn net.Conn, deadline time.Time) bool {
+	err := conn.SetWriteDeadline(deadline)
+	if err != nil {
+		netlog.Warnf("error setting write deadline: %v", err)
+	}
+	for {
+		select {
+		case buf := <-runtime.ircout:
+			if time.Now().After(deadline) {
+				netlog.Warnf("net_writer flush deadline exceeded")
+				return false
+			}
+			if netlog.enabled(LOG_DEBUG) {
+				netlog.Debugf("net_writer: server: %v", logRedact(string(buf)))
+			}
+			capture.record(CAPTURE_OUT, string(buf))
+			_, err := conn.Write(append(buf, []byte{'\r', '\n'}...))
+			if err != nil {
+				netlog.Warnf("write error: %v", err)
+				return false
+			}
+		default:
+			return true
+		}
+	}
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"testing"
+
+	"github.com/ameihm0912/kraz/ircdtest"
+)
+
+func TestParseServer(t *testing.T) {
+	tests := []struct {
+		in   string
+		addr string
+		tls  bool
+		err  bool
+	}{
+		{"127.0.0.1:6697", "127.0.0.1:6697", true, false},
+		{"ircs://irc.example.com", "irc.example.com:6697", true, false},
+		{"ircs://irc.example.com:7000", "irc.example.com:7000", true, false},
+		{"irc://irc.example.com", "irc.example.com:6667", false, false},
+		{"irc://[::1]:6668", "[::1]:6668", false, false},
+		{"http://irc.example.com", "", false, true},
+		{"irc.example.com", "", false, true},
+		{"irc://:6667", "", false, true},
+	}
+	for _, x := range tests {
+		s, err := net_parse_server(x.in)
+		if x.err {
+			if err == nil {
+				t.Errorf("%v: expected error", x.in)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%v: %v", x.in, err)
+			continue
+		}
+		if s.addr != x.addr || s.tls != x.tls {
+			t.Errorf("%v: got %v %v", x.in, s.addr, s.tls)
+		}
+	}
+}
+
+func TestConnectPinned(t *testing.T) {
+	srv, err := ircdtest.NewTLSServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+
+	sum := sha256.Sum256(srv.TLSConfig.Certificates[0].Certificate[0])
+	c := &cfg{
+		Servers:    []string{"ircs://" + srv.Addr},
+		VerifyCert: true,
+		TLS:        tlsCfg{Fingerprints: []string{hex.EncodeToString(sum[:])}},
+	}
+	conn, err := net_connect(c)
+	if err != nil {
+		t.Fatalf("connection with pinned fingerprint failed: %v", err)
+	}
+	conn.Close()
+
+	c.TLS.Fingerprints = []string{hex.EncodeToString(make([]byte, sha256.Size))}
+	_, err = net_connect(c)
+	if err == nil {
+		t.Fatal("connection with wrong fingerprint succeeded")
+	}
+
+	c.TLS.Fingerprints = nil
+	_, err = net_connect(c)
+	if err == nil {
+		t.Fatal("connection to self signed server succeeded with verification")
+	}
+}
+
+func TestConnectPlain(t *testing.T) {
+	srv, err := ircdtest.NewServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+
+	conn, err := net_connect(&cfg{Servers: []string{"irc://" + srv.Addr}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if _, err := conn.Write([]byte("PING :x\r\n")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := srv.Expect("PING :x", testTimeout); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestConnectProxy(t *testing.T) {
+	srv, err := ircdtest.NewTLSServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+
+	socks, err := ircdtest.NewSOCKS5Proxy("user", "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer socks.Close()
+	httpproxy, err := ircdtest.NewHTTPProxy("user", "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer httpproxy.Close()
+
+	tests := []struct {
+		proxy string
+		ok    bool
+	}{
+		{"socks5://user:secret@" + socks.Addr, true},
+		{"socks5://user:wrong@" + socks.Addr, false},
+		{"socks5://" + socks.Addr, false},
+		{"http://user:secret@" + httpproxy.Addr, true},
+		{"http://user:wrong@" + httpproxy.Addr, false},
+	}
+	for _, x := range tests {
+		c := &cfg{
+			Servers:    []string{"ircs://" + srv.Addr},
+			Connection: connectionCfg{Proxy: x.proxy, BindAddress: "127.0.0.1", Family: "ipv4"},
+		}
+		conn, err := net_connect(c)
+		if !x.ok {
+			if err == nil {
+				conn.Close()
+				t.Errorf("%v: expected connection to fail", x.proxy)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%v: %v", x.proxy, err)
+			continue
+		}
+		conn.Write([]byte("PING :proxied\r\n"))
+		if _, err := srv.Expect("PING :proxied", testTimeout); err != nil {
+			t.Errorf("%v: %v", x.proxy, err)
+		}
+		conn.Close()
+	}
+
+	if len(socks.Targets()) == 0 || socks.Targets()[0] != srv.Addr {
+		t.Errorf("unexpected SOCKS5 targets %v", socks.Targets())
+	}
+}
+
+func TestConnectFamily(t *testing.T) {
+	srv, err := ircdtest.NewTLSServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+
+	// The server only listens on IPv4, so preferring IPv6 falls back to it while a
+	// bind address holds the connection to its own family
+	for _, x := range []struct {
+		conn connectionCfg
+		ok   bool
+	}{
+		{connectionCfg{Family: "ipv6"}, true},
+		{connectionCfg{Family: "ipv4"}, true},
+		{connectionCfg{Family: "ipv6", BindAddress: "::1"}, false},
+	} {
+		c := &cfg{Servers: []string{"ircs://" + srv.Addr}, Connection: x.conn}
+		conn, err := net_connect(c)
+		if err != nil {
+			if x.ok {
+				t.Errorf("%+v: %v", x.conn, err)
+			}
+			continue
+		}
+		conn.Close()
+		if !x.ok {
+			t.Errorf("%+v: expected connection to fail", x.conn)
+		}
+	}
+}
@@ -0,0 +1,276 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// Limits applied to module output. A single message is split over at most
+// outputMaxLines lines, and at most outputBurst lines are sent to a target within
+// outputWindow, anything beyond that is dropped.
+var (
+	outputMaxLines = 4
+	outputBurst    = 20
+	outputWindow   = 30 * time.Second
+)
+
+// Maximum length of a line excluding the trailing CR LF
+const outputLineMax = 510
+
+// output is used by modules to send to the server, rather than writing raw protocol
+// lines. Targets are validated and text is sanitized so module supplied data can't
+// inject additional commands. Errors are logged by the implementation.
+type output interface {
+	privmsg(target string, text string) error
+	notice(target string, text string) error
+	action(target string, text string) error
+	// reply sends to the channel a command was issued in, or privately to the sender
+	// if it was sent directly to us
+	reply(src sourceDescriptor, args []string, text string) error
+	join(channel string) error
+	part(channel string, reason string) error
+	mode(target string, modes string, params ...string) error
+	kick(channel string, nick string, reason string) error
+	topic(channel string, topic string) error
+	// labeled returns an output that tags what it sends with label, used by
+	// sendWithReply to match the server's reply
+	labeled(label string) output
+}
+
+// ircOutput is the output implementation writing to the connection
+type ircOutput struct {
+	r     *kruntime
+	sent  map[string][]time.Time // Recent lines sent to each target
+	label string                 // Sent as a label tag if set
+}
+
+// outputClean removes characters that would end the line or be rejected by servers
+func outputClean(s string) string {
+	s = strings.NewReplacer("\r\n", " ", "\r", " ", "\n", " ", "\x00", "").Replace(s)
+	return strings.TrimRight(s, " ")
+}
+
+// outputValidTarget checks a nick or channel may be used as a parameter
+func outputValidTarget(target string) error {
+	if target == "" {
+		return fmt.Errorf("empty target")
+	}
+	if target[0] == ':' || strings.ContainsAny(target, " ,\r\n\x00\x07") {
+		return fmt.Errorf("invalid target %q", target)
+	}
+	return nil
+}
+
+func outputValidChannel(channel string) error {
+	err := outputValidTarget(channel)
+	if err != nil {
+		return err
+	}
+	if channel[0] != '#' && channel[0] != '&' {
+		return fmt.Errorf("%q is not a channel", channel)
+	}
+	return nil
+}
+
+// outputTextMax returns the longest text that can be sent to target with command
+// without being split
+func outputTextMax(command string, target string) int {
+	// The server adds our nick!ident@host to what is relayed, leave room for the
+	// longest it is likely to be
+	return outputLineMax - len(command) - len(target) - 3 - (len(config.Nick) + 77)
+}
+
+// outputSplit splits text into pieces of at most max bytes, preferring to break at
+// spaces and never breaking within a UTF-8 sequence. If max is too small to hold a
+// character, pieces hold a single character.
+func outputSplit(text string, max int) []string {
+	var ret []string
+	if max < 1 {
+		max = 1
+	}
+	for len(text) > max {
+		i := strings.LastIndex(text[:max+1], " ")
+		if i > 0 {
+			ret = append(ret, text[:i])
+			text = text[i+1:]
+			continue
+		}
+		i = max
+		for i > 0 && !utf8.RuneStart(text[i]) {
+			i--
+		}
+		if i == 0 {
+			_, i = utf8.DecodeRuneInString(text)
+		}
+		ret = append(ret, text[:i])
+		text = text[i:]
+	}
+	if text == "" && len(ret) > 0 {
+		return ret
+	}
+	return append(ret, text)
+}
+
+// send queues line for the connection, with our label if there is one
+func (o *ircOutput) send(line string) {
+	if o.label != "" {
+		line = fmt.Sprintf("@label=%v %v", o.label, line)
+	}
+	o.r.ircout <- []byte(line)
+}
+
+// fail logs an output error before it is returned, callers only need to check the
+// error if they want to react to it
+func (o *ircOutput) fail(err error) error {
+	irclog.Warnf("output: %v", err)
+	return err
+}
+
+// allow applies the per target flood limit for n lines
+func (o *ircOutput) allow(target string, n int) bool {
+	if o.sent == nil {
+		o.sent = make(map[string][]time.Time)
+	}
+	key := strings.ToLower(target)
+	now := clockNow()
+	var recent []time.Time
+	for _, x := range o.sent[key] {
+		if now.Sub(x) < outputWindow {
+			recent = append(recent, x)
+		}
+	}
+	if len(recent)+n > outputBurst {
+		o.sent[key] = recent
+		return false
+	}
+	for i := 0; i < n; i++ {
+		recent = append(recent, now)
+	}
+	o.sent[key] = recent
+	return true
+}
+
+// message sends text with command to target, split over as many lines as needed.
+// prefix and suffix wrap the text on every line, used for CTCP.
+func (o *ircOutput) message(command string, target string, text string, prefix string,
+	suffix string) error {
+	err := outputValidTarget(target)
+	if err != nil {
+		return o.fail(err)
+	}
+	text = outputClean(text)
+	if text == "" {
+		return o.fail(fmt.Errorf("empty message"))
+	}
+
+	max := outputTextMax(command, target) - len(prefix) - len(suffix)
+	lines := outputSplit(text, max)
+	if len(lines) > outputMaxLines {
+		last := outputSplit(lines[outputMaxLines-1], max-4)[0]
+		lines = append(lines[:outputMaxLines-1], last+" ...")
+	}
+	if !o.allow(target, len(lines)) {
+		return o.fail(fmt.Errorf("flood limit reached for %v, message dropped", target))
+	}
+	for _, x := range lines {
+		o.send(fmt.Sprintf("%v %v :%v%v%v", command, target, prefix, x, suffix))
+	}
+	return nil
+}
+
+func (o *ircOutput) privmsg(target string, text string) error {
+	return o.message("PRIVMSG", target, text, "", "")
+}
+
+func (o *ircOutput) notice(target string, text string) error {
+	return o.message("NOTICE", target, text, "", "")
+}
+
+func (o *ircOutput) action(target string, text string) error {
+	return o.message("PRIVMSG", target, text, ctcpDelim+"ACTION ", ctcpDelim)
+}
+
+func (o *ircOutput) reply(src sourceDescriptor, args []string, text string) error {
+	return o.privmsg(irc_reply_target(src, args), text)
+}
+
+func (o *ircOutput) join(channel string) error {
+	err := outputValidChannel(channel)
+	if err != nil {
+		return o.fail(err)
+	}
+	o.send(fmt.Sprintf("JOIN %v", channel))
+	return nil
+}
+
+func (o *ircOutput) part(channel string, reason string) error {
+	err := outputValidChannel(channel)
+	if err != nil {
+		return o.fail(err)
+	}
+	reason = outputClean(reason)
+	if reason == "" {
+		o.send(fmt.Sprintf("PART %v", channel))
+	} else {
+		o.send(fmt.Sprintf("PART %v :%v", channel, reason))
+	}
+	return nil
+}
+
+func (o *ircOutput) mode(target string, modes string, params ...string) error {
+	err := outputValidTarget(target)
+	if err != nil {
+		return o.fail(err)
+	}
+	invalid := strings.IndexFunc(modes, func(r rune) bool {
+		return r != '+' && r != '-' && (r < 'a' || r > 'z') && (r < 'A' || r > 'Z')
+	})
+	if modes == "" || invalid != -1 {
+		return o.fail(fmt.Errorf("invalid modes %q", modes))
+	}
+	for _, x := range params {
+		if x == "" || x[0] == ':' || strings.ContainsAny(x, " \r\n\x00") {
+			return o.fail(fmt.Errorf("invalid mode parameter %q", x))
+		}
+	}
+	line := fmt.Sprintf("MODE %v %v", target, modes)
+	if len(params) > 0 {
+		line += " " + strings.Join(params, " ")
+	}
+	o.send(line)
+	return nil
+}
+
+func (o *ircOutput) kick(channel string, nick string, reason string) error {
+	err := outputValidChannel(channel)
+	if err != nil {
+		return o.fail(err)
+	}
+	err = outputValidTarget(nick)
+	if err != nil {
+		return o.fail(err)
+	}
+	o.send(fmt.Sprintf("KICK %v %v :%v", channel, nick, outputClean(reason)))
+	return nil
+}
+
+func (o *ircOutput) topic(channel string, topic string) error {
+	err := outputValidChannel(channel)
+	if err != nil {
+		return o.fail(err)
+	}
+	o.send(fmt.Sprintf("TOPIC %v :%v", channel, outputClean(topic)))
+	return nil
+}
+
+func (o *ircOutput) labeled(label string) output {
+	// The copy shares the flood limit state
+	if o.sent == nil {
+		o.sent = make(map[string][]time.Time)
+	}
+	ret := *o
+	ret.label = label
+	return &ret
+}
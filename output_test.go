@@ -0,0 +1,259 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"testing"
+	"time"
+)
+
+// outputCall is a single call recorded by outputCapture
+type outputCall struct {
+	method string
+	target string
+	text   string
+}
+
+// outputCapture records calls to the output API so module tests can check what
+// would have been sent
+type outputCapture struct {
+	calls []outputCall
+}
+
+// newCaptureRuntime returns a runtime for module tests that records output in oc
+func newCaptureRuntime(oc *outputCapture) *kruntime {
+	return &kruntime{out: oc, registered: true, fetched: make(chan fetchResult, 64)}
+}
+
+// runFetches waits for the background fetches started on r and runs their completions,
+// as the IRC handler would
+func runFetches(t *testing.T, r *kruntime) {
+	t.Helper()
+	for r.fetching > 0 {
+		select {
+		case f := <-r.fetched:
+			r.fetchDone(f)
+		case <-time.After(testTimeout):
+			t.Fatal("timed out waiting for background fetches")
+		}
+	}
+}
+
+// moduleTest runs module commands for tests. Quotes come from a file provider reading
+// a fixture in a temporary directory, which is also used as the state directory.
+type moduleTest struct {
+	t         *testing.T
+	dir       string
+	fixture   string
+	providers []quoteProvider
+	oc        *outputCapture
+	r         *kruntime
+}
+
+func newModuleTest(t *testing.T) *moduleTest {
+	dir, err := ioutil.TempDir("", "kraz")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	config = &cfg{Nick: "kraz", StateDir: dir}
+	symbolCache = make(map[string]symbolCacheEntry)
+
+	m := &moduleTest{t: t, dir: dir, fixture: path.Join(dir, "quotes.json"),
+		oc: &outputCapture{}}
+	m.providers = []quoteProvider{&fileProvider{path: m.fixture}}
+	m.r = newCaptureRuntime(m.oc)
+	return m
+}
+
+// quotes writes the fixture read by the file provider
+func (m *moduleTest) quotes(format string, a ...interface{}) {
+	m.t.Helper()
+	err := ioutil.WriteFile(m.fixture, []byte(fmt.Sprintf(format, a...)), 0644)
+	if err != nil {
+		m.t.Fatal(err)
+	}
+}
+
+// command sends line from src to target and hands it to mod, returning what was sent
+// once any background fetches have completed
+func (m *moduleTest) command(mod module, src sourceDescriptor, target string,
+	line string) []outputCall {
+	m.t.Helper()
+	m.oc.calls = nil
+	args := strings.Split(":"+src.nick+"!a@h PRIVMSG "+target+" :"+line, " ")
+	mod.handleCommand(src, args[3][1:], args, m.r)
+	runFetches(m.t, m.r)
+	return m.oc.calls
+}
+
+// reply runs command for a module that replies with a single line, returning its text
+func (m *moduleTest) reply(mod module, src sourceDescriptor, target string,
+	line string) string {
+	m.t.Helper()
+	calls := m.command(mod, src, target, line)
+	if len(calls) != 1 {
+		m.t.Fatalf("unexpected calls for %q: %v", line, calls)
+	}
+	return calls[0].text
+}
+
+func (o *outputCapture) record(method string, target string, text string) error {
+	o.calls = append(o.calls, outputCall{method, target, text})
+	return nil
+}
+
+func (o *outputCapture) privmsg(target string, text string) error {
+	return o.record("privmsg", target, text)
+}
+
+func (o *outputCapture) notice(target string, text string) error {
+	return o.record("notice", target, text)
+}
+
+func (o *outputCapture) action(target string, text string) error {
+	return o.record("action", target, text)
+}
+
+func (o *outputCapture) reply(src sourceDescriptor, args []string, text string) error {
+	return o.record("privmsg", irc_reply_target(src, args), text)
+}
+
+func (o *outputCapture) join(channel string) error {
+	return o.record("join", channel, "")
+}
+
+func (o *outputCapture) part(channel string, reason string) error {
+	return o.record("part", channel, reason)
+}
+
+func (o *outputCapture) mode(target string, modes string, params ...string) error {
+	return o.record("mode", target, strings.Join(append([]string{modes}, params...), " "))
+}
+
+func (o *outputCapture) kick(channel string, nick string, reason string) error {
+	return o.record("kick", channel, nick+" "+reason)
+}
+
+func (o *outputCapture) topic(channel string, topic string) error {
+	return o.record("topic", channel, topic)
+}
+
+func (o *outputCapture) labeled(label string) output {
+	return o
+}
+
+func outputLines(r *kruntime) []string {
+	var ret []string
+	for {
+		select {
+		case buf := <-r.ircout:
+			ret = append(ret, string(buf))
+		default:
+			return ret
+		}
+	}
+}
+
+func TestOutput(t *testing.T) {
+	config = &cfg{Nick: "kraz"}
+	runtime = kruntime{}
+	runtime.stateInit()
+	out := runtime.out
+
+	// Injected commands end up in the message text
+	out.privmsg("#test", "hello\r\nQUIT :bye")
+	out.notice("alice", "a\nb")
+	out.action("#test", "waves")
+	if err := out.privmsg("#test :x", "hello"); err == nil {
+		t.Fatal("invalid target accepted")
+	}
+	if err := out.kick("alice", "bob", "x"); err == nil {
+		t.Fatal("kick accepted a nick as the channel")
+	}
+	if err := out.mode("#test", "+o", "bob\r\nQUIT"); err == nil {
+		t.Fatal("invalid mode parameter accepted")
+	}
+	out.mode("#test", "+ov", "alice", "bob")
+	want := []string{
+		"PRIVMSG #test :hello QUIT :bye",
+		"NOTICE alice :a b",
+		"PRIVMSG #test :\x01ACTION waves\x01",
+		"MODE #test +ov alice bob",
+	}
+	got := outputLines(&runtime)
+	if strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Fatalf("unexpected output %q", got)
+	}
+
+	// Long messages are split at spaces and limited to outputMaxLines
+	out.privmsg("#long", strings.Repeat("word ", 1000))
+	got = outputLines(&runtime)
+	if len(got) != outputMaxLines || !strings.HasSuffix(got[len(got)-1], " ...") {
+		t.Fatalf("unexpected split into %v lines", len(got))
+	}
+	for _, x := range got {
+		if len(x) > outputLineMax || strings.HasSuffix(x, "wor") {
+			t.Fatalf("bad split %q", x)
+		}
+	}
+
+	// The flood limit applies per target
+	for i := 0; i < outputBurst; i++ {
+		out.privmsg("#flood", "x")
+	}
+	if err := out.privmsg("#flood", "x"); err == nil {
+		t.Fatal("flood limit not applied")
+	}
+	if err := out.privmsg("#other", "x"); err != nil {
+		t.Fatal(err)
+	}
+
+	// A target too long to leave room for any text still makes progress
+	if got := outputSplit("héllo", 0); strings.Join(got, "|") != "h|é|l|l|o" {
+		t.Fatalf("unexpected split %q", got)
+	}
+	if got := outputSplit("é", 1); len(got) != 1 || got[0] != "é" {
+		t.Fatalf("unexpected split %q", got)
+	}
+}
+
+// TestOutputCapture checks module output through the capture
+func TestOutputCapture(t *testing.T) {
+	oc := &outputCapture{}
+	r := &kruntime{out: oc}
+	c := &chanlog{}
+	src := sourceDescriptor{nick: "alice"}
+	c.handleCommand(src, "&grep", []string{":alice!a@h", "PRIVMSG", "#test", ":&grep"}, r)
+	if len(oc.calls) != 1 || oc.calls[0] != (outputCall{"privmsg", "#test",
+		"[grep] usage: &grep <pattern>"}) {
+		t.Fatalf("unexpected calls %v", oc.calls)
+	}
+}
+
+// TestFetchReconnect checks completions of fetches started on a lost connection are
+// dropped, even once registered again
+func TestFetchReconnect(t *testing.T) {
+	oc := &outputCapture{}
+	r := newCaptureRuntime(oc)
+	release := make(chan bool)
+	r.background(func() func() {
+		<-release
+		return func() { r.out.privmsg("#test", "stale") }
+	})
+	r.resetStatus()
+	r.registered = true
+	close(release)
+	runFetches(t, r)
+
+	r.background(func() func() {
+		return func() { r.out.privmsg("#test", "current") }
+	})
+	runFetches(t, r)
+	if len(oc.calls) != 1 || oc.calls[0].text != "current" {
+		t.Fatalf("unexpected calls %v", oc.calls)
+	}
+}
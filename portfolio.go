@@ -0,0 +1,336 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/dustin/go-humanize"
+)
+
+var portfoliolog = newLogger("module:portfolio")
+
+// lot is a purchase of units of a symbol at a price, sales are taken from the oldest
+// lots first
+type lot struct {
+	symbol string
+	units  float64
+	price  float64 // Cost per unit
+	time   time.Time
+}
+
+// holdings is the portfolio of a single user
+type holdings struct {
+	lots     []lot
+	realized float64 // Profit or loss from sales
+}
+
+// lotState and holdingsState are the persisted forms of lot and holdings
+type lotState struct {
+	Symbol string
+	Units  float64
+	Price  float64
+	Time   time.Time
+}
+
+type holdingsState struct {
+	Lots     []lotState
+	Realized float64
+}
+
+// Portfolios by owner, see portfolioKey. Kept outside the module so they survive a
+// configuration reload.
+var portfolios map[string]*holdings
+
+// Fraction of a sale below which leftover units are dropped, see trade
+const portfolioDust = 1e-9
+
+type portfolio struct {
+	providers []quoteProvider
+	workers   int
+	cacheTTL  time.Duration
+}
+
+// portfolioKey returns who a portfolio belongs to, the services account if the server
+// told us the sender is logged in and otherwise the nick
+func portfolioKey(src sourceDescriptor) string {
+	if src.account != "" {
+		return strings.ToLower(src.account)
+	}
+	return strings.ToLower(src.nick)
+}
+
+// portfolioMoney formats v as a dollar amount, with a sign if signed is set
+func portfolioMoney(v float64, signed bool) string {
+	s := "$" + humanize.FormatFloat("#,###.##", math.Abs(v))
+	if v < 0 {
+		return "-" + s
+	}
+	if signed {
+		return "+" + s
+	}
+	return s
+}
+
+// portfolioPercent formats v relative to base, empty if there is no base
+func portfolioPercent(v float64, base float64) string {
+	if base == 0 {
+		return ""
+	}
+	return fmt.Sprintf(" (%+.2f%%)", v/base*100)
+}
+
+func (p *portfolio) initialize() {
+	portfoliolog.Print("portfolio initializing")
+	if portfolios != nil {
+		return
+	}
+	portfolios = make(map[string]*holdings)
+
+	var saved map[string]holdingsState
+	err := stateLoad(p.getName(), &saved)
+	if err != nil {
+		portfoliolog.Errorf("portfolio error loading state: %v", err)
+		return
+	}
+	for k, v := range saved {
+		h := &holdings{realized: v.Realized}
+		for _, x := range v.Lots {
+			h.lots = append(h.lots, lot{symbol: x.Symbol, units: x.Units, price: x.Price,
+				time: x.Time})
+		}
+		portfolios[k] = h
+	}
+	if len(saved) > 0 {
+		portfoliolog.Printf("portfolio restored %v portfolios", len(saved))
+	}
+}
+
+func (p *portfolio) save() error {
+	saved := make(map[string]holdingsState)
+	for k, v := range portfolios {
+		s := holdingsState{Realized: v.realized}
+		for _, x := range v.lots {
+			s.Lots = append(s.Lots, lotState{Symbol: x.symbol, Units: x.units,
+				Price: x.price, Time: x.time})
+		}
+		saved[k] = s
+	}
+	return stateSave(p.getName(), saved)
+}
+
+func (p *portfolio) shutdown() error {
+	return p.save()
+}
+
+func (p *portfolio) getName() string {
+	return "portfolio"
+}
+
+func (p *portfolio) shouldRun() bool {
+	return false
+}
+
+func (p *portfolio) shouldRunOnJoin(channel string) bool {
+	return false
+}
+
+func (p *portfolio) execute(r *kruntime) error {
+	return nil
+}
+
+func (p *portfolio) handlesCommand(cmd string) bool {
+	return cmd == "&buy" || cmd == "&sell" || cmd == "&portfolio"
+}
+
+func (p *portfolio) handlesQuery(cmd string) bool {
+	return p.handlesCommand(cmd)
+}
+
+func (p *portfolio) handleCommand(src sourceDescriptor, cmd string, args []string, r *kruntime) {
+	switch cmd {
+	case "&buy", "&sell":
+		p.trade(src, cmd, args, r)
+	case "&portfolio":
+		p.show(src, args, r)
+	}
+}
+
+// trade handles &buy <symbol> <count> [price] and &sell <symbol> <count> [price], the
+// current price is used if none is given
+func (p *portfolio) trade(src sourceDescriptor, cmd string, args []string, r *kruntime) {
+	tag := "[" + cmd[1:] + "]"
+	params := irc_params(args)
+	if len(params) < 2 {
+		r.out.reply(src, args, fmt.Sprintf("%v usage: %v <symbol> <count> [price]", tag,
+			cmd))
+		return
+	}
+	symbol := strings.ToUpper(params[0])
+	if strings.ContainsAny(symbol, " /?#&") {
+		r.out.reply(src, args, fmt.Sprintf("%v %q is not a valid symbol", tag, params[0]))
+		return
+	}
+	units, err := calcCount(params[1])
+	if err != nil || units <= 0 || math.IsInf(units, 0) {
+		r.out.reply(src, args, fmt.Sprintf("%v %q is not a valid count", tag, params[1]))
+		return
+	}
+	if len(params) >= 3 {
+		price, err := strconv.ParseFloat(strings.Replace(strings.TrimLeft(params[2], "@$"),
+			",", "", -1), 64)
+		if err != nil || price <= 0 || math.IsInf(price, 0) {
+			r.out.reply(src, args, fmt.Sprintf("%v %q is not a valid price", tag, params[2]))
+			return
+		}
+		p.book(src, cmd, args, r, symbol, units, price)
+		return
+	}
+	quoteRequest(r, p.providers, p.workers, p.cacheTTL, []string{symbol},
+		func(found map[string]quote) {
+			q, ok := found[symbol]
+			if !ok {
+				r.out.reply(src, args, fmt.Sprintf("%v no quote found for %v, give a price",
+					tag, symbol))
+				return
+			}
+			p.book(src, cmd, args, r, symbol, units, q.price)
+		})
+}
+
+// book records a trade of units of symbol at price
+func (p *portfolio) book(src sourceDescriptor, cmd string, args []string, r *kruntime,
+	symbol string, units float64, price float64) {
+	tag := "[" + cmd[1:] + "]"
+	key := portfolioKey(src)
+	h := portfolios[key]
+	if h == nil {
+		h = &holdings{}
+	}
+	if cmd == "&buy" {
+		h.lots = append(h.lots, lot{symbol: symbol, units: units, price: price,
+			time: clockNow()})
+		portfolios[key] = h
+		r.out.reply(src, args, fmt.Sprintf("%v %v %v at %v = %v", tag, symbol,
+			humanize.Commaf(units), portfolioMoney(price, false),
+			portfolioMoney(units*price, false)))
+	} else {
+		// Rounding leaves fractions of a unit when lots are summed or split, anything
+		// smaller than this is treated as zero
+		dust := units * portfolioDust
+		held := 0.0
+		for _, x := range h.lots {
+			if x.symbol == symbol {
+				held += x.units
+			}
+		}
+		if units > held+dust {
+			r.out.reply(src, args, fmt.Sprintf("%v you hold %v %v", tag,
+				humanize.Commaf(held), symbol))
+			return
+		}
+
+		// Sell from the oldest lots first
+		remaining := units
+		cost := 0.0
+		var lots []lot
+		for _, x := range h.lots {
+			if x.symbol != symbol || remaining <= dust {
+				lots = append(lots, x)
+				continue
+			}
+			n := math.Min(x.units, remaining)
+			cost += n * x.price
+			remaining -= n
+			x.units -= n
+			if x.units > dust {
+				lots = append(lots, x)
+			}
+		}
+		h.lots = lots
+		pl := units*price - cost
+		h.realized += pl
+		if len(h.lots) == 0 && h.realized == 0 {
+			delete(portfolios, key)
+		}
+		r.out.reply(src, args, fmt.Sprintf("%v %v %v at %v = %v, P/L %v%v", tag, symbol,
+			humanize.Commaf(units), portfolioMoney(price, false),
+			portfolioMoney(units*price, false), portfolioMoney(pl, true),
+			portfolioPercent(pl, cost)))
+	}
+	if err := p.save(); err != nil {
+		portfoliolog.Errorf("portfolio error saving state: %v", err)
+	}
+}
+
+// portfolioPosition is the lots of a symbol in a portfolio combined
+type portfolioPosition struct {
+	units float64
+	cost  float64
+}
+
+// show handles &portfolio, a line for each position followed by the totals
+func (p *portfolio) show(src sourceDescriptor, args []string, r *kruntime) {
+	h := portfolios[portfolioKey(src)]
+	if h == nil {
+		r.out.reply(src, args, "[portfolio] you have no positions, add one with &buy")
+		return
+	}
+	if len(h.lots) == 0 {
+		r.out.reply(src, args, fmt.Sprintf("[portfolio] no open positions, realized %v",
+			portfolioMoney(h.realized, true)))
+		return
+	}
+
+	// Lots of the same symbol are combined into a position
+	positions := make(map[string]*portfolioPosition)
+	var symbols []string
+	for _, x := range h.lots {
+		pos, ok := positions[x.symbol]
+		if !ok {
+			pos = &portfolioPosition{}
+			positions[x.symbol] = pos
+			symbols = append(symbols, x.symbol)
+		}
+		pos.units += x.units
+		pos.cost += x.units * x.price
+	}
+	sort.Strings(symbols)
+	quoteRequest(r, p.providers, p.workers, p.cacheTTL, symbols, func(quotes map[string]quote) {
+		p.value(src, args, r, h.realized, symbols, positions, quotes)
+	})
+}
+
+// value replies with the value of each position and the totals
+func (p *portfolio) value(src sourceDescriptor, args []string, r *kruntime, realized float64,
+	symbols []string, positions map[string]*portfolioPosition, quotes map[string]quote) {
+	var value, cost, day float64
+	for _, sym := range symbols {
+		pos := positions[sym]
+		q, ok := quotes[sym]
+		if !ok {
+			r.out.reply(src, args, fmt.Sprintf("[portfolio] %v %v cost %v, no quote",
+				sym, humanize.Commaf(pos.units), portfolioMoney(pos.cost, false)))
+			continue
+		}
+		v := pos.units * q.price
+		pl := v - pos.cost
+		value += v
+		cost += pos.cost
+		day += pos.units * q.change
+		r.out.reply(src, args, fmt.Sprintf("[portfolio] %v %v x %v = %v, day %v, P/L %v%v",
+			sym, humanize.Commaf(pos.units), portfolioMoney(q.price, false),
+			portfolioMoney(v, false), portfolioMoney(pos.units*q.change, true),
+			portfolioMoney(pl, true), portfolioPercent(pl, pos.cost)))
+	}
+	msg := fmt.Sprintf("[portfolio] total %v, day %v, P/L %v%v", portfolioMoney(value, false),
+		portfolioMoney(day, true), portfolioMoney(value-cost, true),
+		portfolioPercent(value-cost, cost))
+	if realized != 0 {
+		msg += fmt.Sprintf(", realized %v", portfolioMoney(realized, true))
+	}
+	r.out.reply(src, args, msg)
+}
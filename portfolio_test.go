@@ -0,0 +1,76 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestPortfolio(t *testing.T) {
+	m := newModuleTest(t)
+	portfolios = nil
+	symbolCache["MSFT"] = symbolCacheEntry{currentPrice: 300, change: 3, percent: 1,
+		fetched: clockNow()}
+	defer func() { portfolios = nil }()
+	m.quotes(`{"AAPL": {"Price": 150, "Change": -2}}`)
+
+	p := &portfolio{providers: m.providers, workers: 1, cacheTTL: time.Minute}
+	p.initialize()
+
+	command := func(src sourceDescriptor, line string) []string {
+		var ret []string
+		for _, x := range m.command(p, src, "#test", line) {
+			ret = append(ret, x.text)
+		}
+		return ret
+	}
+	expect := func(got []string, want ...string) {
+		if fmt.Sprint(got) != fmt.Sprint(want) {
+			t.Fatalf("unexpected output %q, wanted %q", got, want)
+		}
+	}
+
+	// Portfolios follow the account rather than the nick when it is known
+	alice := sourceDescriptor{nick: "alice", account: "Alice"}
+	expect(command(alice, "&buy msft 10 250"), "[buy] MSFT 10 at $250.00 = $2,500.00")
+	expect(command(sourceDescriptor{nick: "alice_", account: "alice"}, "&buy AAPL 1k"),
+		"[buy] AAPL 1,000 at $150.00 = $150,000.00")
+	expect(command(alice, "&buy MSFT 10 280"), "[buy] MSFT 10 at $280.00 = $2,800.00")
+	expect(command(alice, "&sell MSFT 100"), "[sell] you hold 20 MSFT")
+	expect(command(alice, "&sell MSFT 15 290"),
+		"[sell] MSFT 15 at $290.00 = $4,350.00, P/L +$450.00 (+11.54%)")
+
+	// Restored from state
+	if err := p.shutdown(); err != nil {
+		t.Fatal(err)
+	}
+	portfolios = nil
+	p.initialize()
+	expect(command(alice, "&portfolio"),
+		"[portfolio] AAPL 1,000 x $150.00 = $150,000.00, day -$2,000.00, P/L +$0.00 (+0.00%)",
+		"[portfolio] MSFT 5 x $300.00 = $1,500.00, day +$15.00, P/L +$100.00 (+7.14%)",
+		"[portfolio] total $151,500.00, day -$1,985.00, P/L +$100.00 (+0.07%), "+
+			"realized +$450.00")
+	expect(command(sourceDescriptor{nick: "bob"}, "&portfolio"),
+		"[portfolio] you have no positions, add one with &buy")
+	expect(command(sourceDescriptor{nick: "bob"}, "&buy  AAPL  5 100"),
+		"[buy] AAPL 5 at $100.00 = $500.00")
+	expect(command(sourceDescriptor{nick: "bob"}, "&sell  AAPL"),
+		"[sell] usage: &sell <symbol> <count> [price]")
+
+	// Unit suffixes multiply rather than replace the decimal point
+	carol := sourceDescriptor{nick: "carol"}
+	expect(command(carol, "&buy AAPL 1.5k 100"), "[buy] AAPL 1,500 at $100.00 = $150,000.00")
+	expect(command(carol, "&buy AAPL 1.5x 100"), `[buy] "1.5x" is not a valid count`)
+
+	// Selling everything across several lots leaves no rounding remainder behind
+	expect(command(carol, "&buy MSFT 0.1 10"), "[buy] MSFT 0.1 at $10.00 = $1.00")
+	expect(command(carol, "&buy MSFT 0.2 10"), "[buy] MSFT 0.2 at $10.00 = $2.00")
+	expect(command(carol, "&sell MSFT 0.3 10"),
+		"[sell] MSFT 0.3 at $10.00 = $3.00, P/L +$0.00 (+0.00%)")
+	expect(command(carol, "&sell AAPL 1,500 100"),
+		"[sell] AAPL 1,500 at $100.00 = $150,000.00, P/L +$0.00 (+0.00%)")
+	if h := portfolios["carol"]; h != nil && len(h.lots) != 0 {
+		t.Fatalf("unexpected lots left %+v", h)
+	}
+}
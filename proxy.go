@@ -0,0 +1,282 @@
+package main
+
+import (
+	"bufio"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// Timeout for establishing a TCP connection and completing any proxy handshake
+var dialTimeout = 30 * time.Second
+
+// net_parse_proxy parses a proxy URL, socks5://[user:pass@]host:port or
+// http://[user:pass@]host:port
+func net_parse_proxy(s string) (*url.URL, error) {
+	u, err := url.Parse(s)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "socks5" && u.Scheme != "http" {
+		return nil, fmt.Errorf("unknown proxy scheme %q, must be socks5 or http", u.Scheme)
+	}
+	if u.Hostname() == "" || u.Port() == "" {
+		return nil, fmt.Errorf("proxy must be specified as host:port")
+	}
+	return u, nil
+}
+
+// net_networks returns the networks to dial in order, the preferred address family
+// first and then the other. A bind address only works with its own family so there is
+// nothing to fall back to.
+func net_networks(c *cfg) []string {
+	switch {
+	case c.Connection.Family == "ipv4" && c.Connection.BindAddress != "":
+		return []string{"tcp4"}
+	case c.Connection.Family == "ipv6" && c.Connection.BindAddress != "":
+		return []string{"tcp6"}
+	case c.Connection.Family == "ipv4":
+		return []string{"tcp4", "tcp6"}
+	case c.Connection.Family == "ipv6":
+		return []string{"tcp6", "tcp4"}
+	}
+	return []string{"tcp"}
+}
+
+// net_dial_preferred dials addr using the preferred address family, falling back to
+// the other if that fails
+func net_dial_preferred(c *cfg, d *net.Dialer, addr string) (net.Conn, error) {
+	networks := net_networks(c)
+	conn, err := d.Dial(networks[0], addr)
+	if err != nil && len(networks) > 1 {
+		netlog.Warnf("connecting to %v over %v failed, trying %v: %v", addr, networks[0],
+			networks[1], err)
+		conn, err = d.Dial(networks[1], addr)
+	}
+	return conn, err
+}
+
+// net_dial_tcp establishes the TCP connection to addr, applying the bind address
+// and address family preference, and tunneling through the proxy if one is set
+func net_dial_tcp(c *cfg, addr string) (net.Conn, error) {
+	d := &net.Dialer{Timeout: dialTimeout}
+	if c.Connection.BindAddress != "" {
+		ip := net.ParseIP(c.Connection.BindAddress)
+		if ip == nil {
+			return nil, fmt.Errorf("invalid bind address %v", c.Connection.BindAddress)
+		}
+		d.LocalAddr = &net.TCPAddr{IP: ip}
+	}
+
+	if c.Connection.Proxy == "" {
+		return net_dial_preferred(c, d, addr)
+	}
+
+	u, err := net_parse_proxy(c.Connection.Proxy)
+	if err != nil {
+		return nil, err
+	}
+	netlog.Printf("connecting to %v through %v proxy %v", addr, u.Scheme, u.Host)
+	conn, err := net_dial_preferred(c, d, u.Host)
+	if err != nil {
+		return nil, err
+	}
+
+	// Bound the proxy handshake so a stalled proxy can't hang the connection
+	conn.SetDeadline(time.Now().Add(dialTimeout))
+	switch u.Scheme {
+	case "socks5":
+		err = net_socks5_connect(conn, u, addr)
+	case "http":
+		conn, err = net_http_connect(conn, u, addr)
+	}
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("proxy: %v", err)
+	}
+	conn.SetDeadline(time.Time{})
+	return conn, nil
+}
+
+const (
+	socks5Version      = 0x05
+	socks5AuthNone     = 0x00
+	socks5AuthPassword = 0x02
+	socks5AuthNoAccept = 0xff
+	socks5CmdConnect   = 0x01
+	socks5AtypIPv4     = 0x01
+	socks5AtypDomain   = 0x03
+	socks5AtypIPv6     = 0x04
+)
+
+var socks5Errors = map[byte]string{
+	0x01: "general server failure",
+	0x02: "connection not allowed by ruleset",
+	0x03: "network unreachable",
+	0x04: "host unreachable",
+	0x05: "connection refused",
+	0x06: "TTL expired",
+	0x07: "command not supported",
+	0x08: "address type not supported",
+}
+
+// net_socks5_connect performs the SOCKS5 handshake (RFC 1928), authenticating with
+// username and password (RFC 1929) if the proxy URL includes them
+func net_socks5_connect(conn net.Conn, u *url.URL, addr string) error {
+	host, portstr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return err
+	}
+	port, err := strconv.Atoi(portstr)
+	if err != nil {
+		return err
+	}
+
+	method := byte(socks5AuthNone)
+	if u.User != nil {
+		method = socks5AuthPassword
+	}
+	_, err = conn.Write([]byte{socks5Version, 1, method})
+	if err != nil {
+		return err
+	}
+	resp := make([]byte, 2)
+	_, err = io.ReadFull(conn, resp)
+	if err != nil {
+		return err
+	}
+	if resp[0] != socks5Version {
+		return fmt.Errorf("unexpected SOCKS version %v", resp[0])
+	}
+	if resp[1] == socks5AuthNoAccept || resp[1] != method {
+		return fmt.Errorf("no acceptable authentication method")
+	}
+
+	if method == socks5AuthPassword {
+		user := u.User.Username()
+		pass, _ := u.User.Password()
+		if len(user) > 255 || len(pass) > 255 {
+			return fmt.Errorf("username or password too long")
+		}
+		req := []byte{0x01, byte(len(user))}
+		req = append(req, user...)
+		req = append(req, byte(len(pass)))
+		req = append(req, pass...)
+		_, err = conn.Write(req)
+		if err != nil {
+			return err
+		}
+		_, err = io.ReadFull(conn, resp)
+		if err != nil {
+			return err
+		}
+		if resp[1] != 0 {
+			return fmt.Errorf("authentication failed")
+		}
+	}
+
+	req := []byte{socks5Version, socks5CmdConnect, 0}
+	if ip := net.ParseIP(host); ip != nil && ip.To4() != nil {
+		req = append(req, socks5AtypIPv4)
+		req = append(req, ip.To4()...)
+	} else if ip != nil {
+		req = append(req, socks5AtypIPv6)
+		req = append(req, ip.To16()...)
+	} else {
+		if len(host) > 255 {
+			return fmt.Errorf("host name too long")
+		}
+		req = append(req, socks5AtypDomain, byte(len(host)))
+		req = append(req, host...)
+	}
+	req = append(req, 0, 0)
+	binary.BigEndian.PutUint16(req[len(req)-2:], uint16(port))
+	_, err = conn.Write(req)
+	if err != nil {
+		return err
+	}
+
+	hdr := make([]byte, 4)
+	_, err = io.ReadFull(conn, hdr)
+	if err != nil {
+		return err
+	}
+	if hdr[1] != 0 {
+		msg, ok := socks5Errors[hdr[1]]
+		if !ok {
+			msg = fmt.Sprintf("error %v", hdr[1])
+		}
+		return fmt.Errorf("connect failed: %v", msg)
+	}
+	// Discard the bound address in the reply
+	var n int
+	switch hdr[3] {
+	case socks5AtypIPv4:
+		n = net.IPv4len
+	case socks5AtypIPv6:
+		n = net.IPv6len
+	case socks5AtypDomain:
+		l := make([]byte, 1)
+		_, err = io.ReadFull(conn, l)
+		if err != nil {
+			return err
+		}
+		n = int(l[0])
+	default:
+		return fmt.Errorf("unexpected address type %v in reply", hdr[3])
+	}
+	_, err = io.ReadFull(conn, make([]byte, n+2))
+	return err
+}
+
+// bufferedConn returns data already read into a bufio.Reader before reading from
+// the underlying connection
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (b *bufferedConn) Read(p []byte) (int, error) {
+	return b.r.Read(p)
+}
+
+// net_http_connect establishes a tunnel through an HTTP proxy using CONNECT
+func net_http_connect(conn net.Conn, u *url.URL, addr string) (net.Conn, error) {
+	req := &http.Request{
+		Method: "CONNECT",
+		URL:    &url.URL{Opaque: addr},
+		Host:   addr,
+		Header: make(http.Header),
+	}
+	if u.User != nil {
+		pass, _ := u.User.Password()
+		cred := base64.StdEncoding.EncodeToString([]byte(u.User.Username() + ":" + pass))
+		req.Header.Set("Proxy-Authorization", "Basic "+cred)
+	}
+	err := req.Write(conn)
+	if err != nil {
+		return conn, err
+	}
+
+	// The response is read as a reply to the CONNECT, so a successful one has no body
+	// and what follows is the tunnelled connection
+	r := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(r, req)
+	if err != nil {
+		return conn, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return conn, fmt.Errorf("CONNECT returned %v", resp.Status)
+	}
+	if r.Buffered() > 0 {
+		return &bufferedConn{Conn: conn, r: r}, nil
+	}
+	return conn, nil
+}
@@ -0,0 +1,476 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	yahooQuoteURL   = "https://query1.finance.yahoo.com/v8/finance/chart/"
+	yahooHistoryURL = "https://query1.finance.yahoo.com/v8/finance/chart/"
+	stooqQuoteURL   = "https://stooq.com/q/l/"
+	stooqHistoryURL = "https://stooq.com/q/d/l/"
+)
+
+// quote is a price quote for a single symbol
+type quote struct {
+	symbol   string
+	price    float64
+	change   float64 // Change since the previous close
+	percent  float64 // Change since the previous close as a percentage
+	currency string  // ISO currency code, empty if the provider doesn't say
+	state    string  // Market state such as REGULAR, PRE, POST or CLOSED, empty if unknown
+	time     time.Time
+}
+
+// quoteProvider is a source of quotes, the ticker tries the configured providers in
+// order until one succeeds
+type quoteProvider interface {
+	getName() string
+	quote(symbol string) (quote, error)
+}
+
+// newQuoteProviders creates providers from their configuration, Yahoo is used if none
+// are configured. The providers share a single HTTP client configured by h.
+func newQuoteProviders(c []quoteProviderCfg, h httpCfg) ([]quoteProvider, error) {
+	client := newQuoteHTTP(h)
+	if len(c) == 0 {
+		return []quoteProvider{&yahooProvider{url: yahooQuoteURL, historyURL: yahooHistoryURL,
+			http: client}}, nil
+	}
+	var ret []quoteProvider
+	for _, x := range c {
+		switch x.Type {
+		case "yahoo":
+			p := &yahooProvider{url: x.URL, historyURL: x.HistoryURL, http: client}
+			if p.url == "" {
+				p.url = yahooQuoteURL
+			}
+			if p.historyURL == "" {
+				p.historyURL = yahooHistoryURL
+			}
+			ret = append(ret, p)
+		case "stooq":
+			p := &stooqProvider{url: x.URL, historyURL: x.HistoryURL, suffix: x.Suffix,
+				http: client}
+			if p.url == "" {
+				p.url = stooqQuoteURL
+			}
+			if p.historyURL == "" {
+				p.historyURL = stooqHistoryURL
+			}
+			if p.suffix == "" {
+				p.suffix = ".us"
+			}
+			ret = append(ret, p)
+		case "file":
+			ret = append(ret, &fileProvider{path: x.Path})
+		default:
+			return nil, fmt.Errorf("unknown quote provider %q", x.Type)
+		}
+	}
+	return ret, nil
+}
+
+// quoteFetch returns a quote from the first provider that has one
+func quoteFetch(providers []quoteProvider, symbol string) (quote, error) {
+	var errs []string
+	for _, p := range providers {
+		q, err := p.quote(symbol)
+		if err == nil {
+			return q, nil
+		}
+		tickerlog.Debugf("ticker %v provider failed for %v: %v", p.getName(), symbol, err)
+		errs = append(errs, fmt.Sprintf("%v: %v", p.getName(), err))
+	}
+	return quote{}, fmt.Errorf("no quote for %v (%v)", symbol, strings.Join(errs, "; "))
+}
+
+// quoteFormatPrice formats a price with two decimal places, or four for prices below
+// one
+func quoteFormatPrice(v float64) string {
+	if v < 1 && v > -1 {
+		return strconv.FormatFloat(v, 'f', 4, 64)
+	}
+	return strconv.FormatFloat(v, 'f', 2, 64)
+}
+
+// quoteFormatChange formats the change in a quote, for example +1.25 (+0.98%)
+func quoteFormatChange(q quote) string {
+	return fmt.Sprintf("%+.2f (%+.2f%%)", q.change, q.percent)
+}
+
+// Delay before the first retry of a failed request, doubled for each further attempt
+var quoteRetryDelay = time.Second
+
+// The longest we will wait before a retry, even if the server asks for longer
+const quoteRetryMax = 5 * time.Second
+
+// Set when replaying a capture, requests then fail without being made so replies don't
+// depend on live prices
+var quoteOffline = false
+
+// quoteHTTP is the HTTP client shared by the quote providers, so connections to a
+// provider are reused between symbols
+type quoteHTTP struct {
+	client    *http.Client
+	userAgent string
+	retries   int
+}
+
+func newQuoteHTTP(c httpCfg) *quoteHTTP {
+	// Durations were validated when the configuration was loaded
+	timeout := 10 * time.Second
+	if c.Timeout != "" {
+		timeout, _ = time.ParseDuration(c.Timeout)
+	}
+	connect := 5 * time.Second
+	if c.ConnectTimeout != "" {
+		connect, _ = time.ParseDuration(c.ConnectTimeout)
+	}
+	retries := 2
+	if c.Retries != nil {
+		retries = *c.Retries
+	}
+	return &quoteHTTP{
+		client: &http.Client{
+			Timeout: timeout,
+			Transport: &http.Transport{
+				Proxy:                 http.ProxyFromEnvironment,
+				DialContext:           (&net.Dialer{Timeout: connect}).DialContext,
+				TLSHandshakeTimeout:   connect,
+				ResponseHeaderTimeout: timeout,
+				MaxIdleConnsPerHost:   8,
+				IdleConnTimeout:       90 * time.Second,
+			},
+		},
+		userAgent: c.UserAgent,
+		retries:   retries,
+	}
+}
+
+// retryable returns true for responses worth retrying, rate limiting and server errors
+func retryable(status int) bool {
+	return status == http.StatusTooManyRequests || status >= 500
+}
+
+// get requests u, returning the body if the request succeeded. Network errors, 429
+// and 5xx responses are retried with backoff.
+func (h *quoteHTTP) get(u string) ([]byte, error) {
+	delay := quoteRetryDelay
+	var err error
+	for attempt := 0; attempt <= h.retries; attempt++ {
+		if attempt > 0 {
+			tickerlog.Debugf("ticker retrying %v in %v: %v", u, delay, err)
+			time.Sleep(delay)
+			delay *= 2
+		}
+		var buf []byte
+		var wait time.Duration
+		buf, wait, err = h.try(u)
+		if err == nil {
+			return buf, nil
+		}
+		if wait < 0 {
+			break
+		}
+		if wait > delay {
+			delay = wait
+		}
+		if delay > quoteRetryMax {
+			delay = quoteRetryMax
+		}
+	}
+	return nil, err
+}
+
+// try makes a single request. On failure wait is negative if the request shouldn't be
+// retried, otherwise it is any delay the server asked for.
+func (h *quoteHTTP) try(u string) (buf []byte, wait time.Duration, err error) {
+	if quoteOffline {
+		return nil, -1, fmt.Errorf("requests are disabled while replaying")
+	}
+	tickerlog.Debugf("ticker requesting %v", u)
+	req, err := http.NewRequest("GET", u, nil)
+	if err != nil {
+		return nil, -1, err
+	}
+	if h.userAgent != "" {
+		req.Header.Set("User-Agent", h.userAgent)
+	}
+
+	r, err := h.client.Do(req)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer r.Body.Close()
+
+	if r.StatusCode != 200 {
+		// Drain the body so the connection can be reused
+		io.Copy(ioutil.Discard, r.Body)
+		err = fmt.Errorf("request returned status code %v", r.StatusCode)
+		if !retryable(r.StatusCode) {
+			return nil, -1, err
+		}
+		if n, perr := strconv.Atoi(r.Header.Get("Retry-After")); perr == nil && n > 0 {
+			wait = time.Duration(n) * time.Second
+		}
+		return nil, wait, err
+	}
+	buf, err = ioutil.ReadAll(r.Body)
+	return buf, 0, err
+}
+
+// quoteResult is the outcome of fetching a single symbol
+type quoteResult struct {
+	symbol string
+	quote  quote
+	err    error
+}
+
+// quoteFetchAll fetches quotes for symbols using up to workers concurrent requests,
+// the results are in the same order as symbols
+func quoteFetchAll(providers []quoteProvider, symbols []string, workers int) []quoteResult {
+	ret := make([]quoteResult, len(symbols))
+	if workers < 1 {
+		workers = 1
+	}
+	jobs := make(chan int)
+	var wg sync.WaitGroup
+	for i := 0; i < workers && i < len(symbols); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := range jobs {
+				q, err := quoteFetch(providers, symbols[j])
+				ret[j] = quoteResult{symbol: symbols[j], quote: q, err: err}
+			}
+		}()
+	}
+	for i := range symbols {
+		jobs <- i
+	}
+	close(jobs)
+	wg.Wait()
+	return ret
+}
+
+// yahooProvider uses the JSON chart endpoint behind Yahoo Finance. The v7 quote endpoint
+// needs a session cookie and crumb, the chart metadata has the current price without
+// either.
+type yahooProvider struct {
+	url        string
+	historyURL string
+	http       *quoteHTTP
+}
+
+func (y *yahooProvider) getName() string {
+	return "yahoo"
+}
+
+// yahooPeriod is a trading session in the chart metadata, as unix times
+type yahooPeriod struct {
+	Start int64
+	End   int64
+}
+
+func (p yahooPeriod) contains(tm int64) bool {
+	return tm >= p.Start && tm < p.End
+}
+
+func (y *yahooProvider) quote(symbol string) (quote, error) {
+	buf, err := y.http.get(y.url + url.PathEscape(symbol) + "?range=1d&interval=1d")
+	if err != nil {
+		return quote{}, err
+	}
+
+	var resp struct {
+		Chart struct {
+			Result []struct {
+				Meta struct {
+					Symbol               string
+					Currency             string
+					RegularMarketPrice   *float64
+					ChartPreviousClose   float64
+					RegularMarketTime    int64
+					CurrentTradingPeriod struct {
+						Pre     yahooPeriod
+						Regular yahooPeriod
+						Post    yahooPeriod
+					}
+				}
+			}
+			Error *struct {
+				Description string
+			}
+		}
+	}
+	err = json.Unmarshal(buf, &resp)
+	if err != nil {
+		return quote{}, err
+	}
+	if resp.Chart.Error != nil {
+		return quote{}, fmt.Errorf("%v", resp.Chart.Error.Description)
+	}
+	for _, x := range resp.Chart.Result {
+		m := x.Meta
+		if !strings.EqualFold(m.Symbol, symbol) {
+			continue
+		}
+		if m.RegularMarketPrice == nil {
+			return quote{}, fmt.Errorf("no price for %v", symbol)
+		}
+		ret := quote{
+			symbol:   symbol,
+			price:    *m.RegularMarketPrice,
+			currency: m.Currency,
+			state:    "CLOSED",
+			time:     time.Unix(m.RegularMarketTime, 0),
+		}
+		if m.ChartPreviousClose != 0 {
+			ret.change = ret.price - m.ChartPreviousClose
+			ret.percent = ret.change / m.ChartPreviousClose * 100
+		}
+		now := clockNow().Unix()
+		switch {
+		case m.CurrentTradingPeriod.Regular.contains(now):
+			ret.state = "REGULAR"
+		case m.CurrentTradingPeriod.Pre.contains(now):
+			ret.state = "PRE"
+		case m.CurrentTradingPeriod.Post.contains(now):
+			ret.state = "POST"
+		}
+		return ret, nil
+	}
+	return quote{}, fmt.Errorf("symbol %v not found", symbol)
+}
+
+// stooqProvider uses the CSV quote endpoint from stooq.com. Stooq symbols include the
+// market, suffix is appended to symbols that don't have one.
+type stooqProvider struct {
+	url        string
+	historyURL string
+	suffix     string
+	http       *quoteHTTP
+}
+
+func (s *stooqProvider) getName() string {
+	return "stooq"
+}
+
+// symbol returns symbol as stooq expects it
+func (s *stooqProvider) symbol(symbol string) string {
+	sym := strings.ToLower(symbol)
+	if !strings.Contains(sym, ".") {
+		sym += s.suffix
+	}
+	return sym
+}
+
+func (s *stooqProvider) quote(symbol string) (quote, error) {
+	sym := s.symbol(symbol)
+	// Symbol, date, time, open, high, low, close, previous close, with a header row
+	buf, err := s.http.get(s.url + "?s=" + url.QueryEscape(sym) + "&f=sd2t2ohlcp&h&e=csv")
+	if err != nil {
+		return quote{}, err
+	}
+
+	rows, err := csv.NewReader(strings.NewReader(string(buf))).ReadAll()
+	if err != nil {
+		return quote{}, err
+	}
+	if len(rows) != 2 {
+		return quote{}, fmt.Errorf("unexpected response with %v rows", len(rows))
+	}
+	fields := make(map[string]string)
+	for i, x := range rows[0] {
+		if i < len(rows[1]) {
+			fields[strings.ToLower(x)] = rows[1][i]
+		}
+	}
+	// Unknown symbols are returned with N/D in place of values
+	price, err := strconv.ParseFloat(fields["close"], 64)
+	if err != nil {
+		return quote{}, fmt.Errorf("no price for %v", symbol)
+	}
+	ret := quote{symbol: symbol, price: price}
+	for _, k := range []string{"prev", "previous", "prev close"} {
+		prev, err := strconv.ParseFloat(fields[k], 64)
+		if err == nil && prev != 0 {
+			ret.change = price - prev
+			ret.percent = ret.change / prev * 100
+			break
+		}
+	}
+	tm, err := time.Parse("2006-01-02 15:04:05", fields["date"]+" "+fields["time"])
+	if err == nil {
+		ret.time = tm
+	}
+	return ret, nil
+}
+
+// fileProvider reads quotes from a local JSON file, a map of symbol to quote. It is
+// reread on every request, so it can serve as a fixture for testing or be maintained
+// by another program.
+type fileProvider struct {
+	path string
+}
+
+type fileQuote struct {
+	Price    float64
+	Change   float64
+	Percent  float64
+	Currency string
+	State    string
+	Time     time.Time
+	History  map[string][]fileBar // Price history by period, such as 1mo
+}
+
+func (f *fileProvider) getName() string {
+	return "file"
+}
+
+// load returns the entry for symbol from the file
+func (f *fileProvider) load(symbol string) (fileQuote, error) {
+	buf, err := ioutil.ReadFile(f.path)
+	if err != nil {
+		return fileQuote{}, err
+	}
+	var quotes map[string]fileQuote
+	err = json.Unmarshal(buf, &quotes)
+	if err != nil {
+		return fileQuote{}, fmt.Errorf("%v: %v", f.path, err)
+	}
+	for k, v := range quotes {
+		if strings.EqualFold(k, symbol) {
+			return v, nil
+		}
+	}
+	return fileQuote{}, fmt.Errorf("symbol %v not found", symbol)
+}
+
+func (f *fileProvider) quote(symbol string) (quote, error) {
+	v, err := f.load(symbol)
+	if err != nil {
+		return quote{}, err
+	}
+	return quote{
+		symbol:   symbol,
+		price:    v.Price,
+		change:   v.Change,
+		percent:  v.Percent,
+		currency: v.Currency,
+		state:    v.State,
+		time:     v.Time,
+	}, nil
+}
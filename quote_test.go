@@ -0,0 +1,293 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestQuoteProviders(t *testing.T) {
+	config = &cfg{}
+	clockNow = func() time.Time { return time.Unix(1600000000, 0) }
+	defer func() { clockNow = time.Now }()
+
+	yahoo := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/MSFT" {
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte(`{"chart":{"result":null,"error":{"code":"Not Found",
+				"description":"No data found, symbol may be delisted"}}}`))
+			return
+		}
+		w.Write([]byte(`{"chart":{"result":[{"meta":{"symbol":"MSFT","currency":"USD",
+			"regularMarketPrice":301.5,"chartPreviousClose":303,
+			"regularMarketTime":1600000000,"currentTradingPeriod":{
+			"pre":{"start":1599984000,"end":1599989400},
+			"regular":{"start":1599989400,"end":1600012800},
+			"post":{"start":1600012800,"end":1600027200}}}}],"error":null}}`))
+	}))
+	defer yahoo.Close()
+
+	stooq := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("s") != "aapl.us" {
+			w.Write([]byte("Symbol,Date,Time,Open,High,Low,Close,Prev\r\n" +
+				"X.US,N/D,N/D,N/D,N/D,N/D,N/D,N/D\r\n"))
+			return
+		}
+		w.Write([]byte("Symbol,Date,Time,Open,High,Low,Close,Prev\r\n" +
+			"AAPL.US,2020-09-14,22:00:00,114.72,115.93,112.8,115.36,112.00\r\n"))
+	}))
+	defer stooq.Close()
+
+	dir, err := ioutil.TempDir("", "kraz")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	fixture := path.Join(dir, "quotes.json")
+	err = ioutil.WriteFile(fixture, []byte(`{"TEST": {"Price": 0.5, "Change": 0.01,
+		"Percent": 2.04, "Currency": "CAD", "State": "CLOSED"}}`), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	providers, err := newQuoteProviders([]quoteProviderCfg{
+		{Type: "yahoo", URL: yahoo.URL + "/"},
+		{Type: "stooq", URL: stooq.URL},
+		{Type: "file", Path: fixture},
+	}, httpCfg{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	q, err := quoteFetch(providers, "MSFT")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if q.price != 301.5 || quoteFormatChange(q) != "-1.50 (-0.50%)" || q.currency != "USD" ||
+		q.state != "REGULAR" || q.time.Unix() != 1600000000 {
+		t.Fatalf("unexpected yahoo quote %+v", q)
+	}
+
+	// Yahoo doesn't know AAPL here, stooq is used
+	q, err = quoteFetch(providers, "AAPL")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if q.price != 115.36 || quoteFormatChange(q) != "+3.36 (+3.00%)" {
+		t.Fatalf("unexpected stooq quote %+v", q)
+	}
+
+	q, err = quoteFetch(providers, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if quoteFormatPrice(q.price) != "0.5000" || q.currency != "CAD" {
+		t.Fatalf("unexpected file quote %+v", q)
+	}
+
+	if _, err := quoteFetch(providers, "NONE"); err == nil {
+		t.Fatal("expected an error for an unknown symbol")
+	}
+	if _, err := newQuoteProviders([]quoteProviderCfg{{Type: "bogus"}}, httpCfg{}); err == nil {
+		t.Fatal("unknown provider accepted")
+	}
+}
+
+func TestQuoteRetry(t *testing.T) {
+	config = &cfg{}
+	oldDelay := quoteRetryDelay
+	quoteRetryDelay = time.Millisecond
+	defer func() { quoteRetryDelay = oldDelay }()
+
+	var mu sync.Mutex
+	requests := make(map[string]int)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		sym := strings.TrimPrefix(r.URL.Path, "/")
+		mu.Lock()
+		requests[sym]++
+		n := requests[sym]
+		mu.Unlock()
+		switch {
+		case sym == "GONE":
+			w.WriteHeader(http.StatusNotFound)
+		case n == 1:
+			w.WriteHeader(http.StatusServiceUnavailable)
+		default:
+			fmt.Fprintf(w, `{"chart":{"result":[{"meta":{"symbol":%q,
+				"regularMarketPrice":%v}}]}}`, sym, len(sym))
+		}
+	}))
+	defer srv.Close()
+
+	providers, err := newQuoteProviders([]quoteProviderCfg{{Type: "yahoo", URL: srv.URL + "/"}},
+		httpCfg{Timeout: "2s"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	symbols := []string{"A", "BB", "CCC", "GONE", "EEEEE"}
+	res := quoteFetchAll(providers, symbols, 3)
+	for i, x := range res {
+		if x.symbol != symbols[i] {
+			t.Fatalf("result %v is for %v", i, x.symbol)
+		}
+		if x.symbol == "GONE" {
+			if x.err == nil {
+				t.Fatal("expected an error for GONE")
+			}
+			continue
+		}
+		if x.err != nil || x.quote.price != float64(len(x.symbol)) {
+			t.Fatalf("unexpected result %+v", x)
+		}
+	}
+	// Only the 503 is retried
+	if requests["A"] != 2 || requests["GONE"] != 1 {
+		t.Fatalf("unexpected request counts %v", requests)
+	}
+}
+
+func TestTickerLayout(t *testing.T) {
+	quotes := []quote{
+		{symbol: "MSFT", price: 410.5, change: 2.25, percent: 0.55},
+		{symbol: "T", price: 17, change: -0.1, percent: -0.58},
+		{symbol: "BTC-USD", price: 0.5},
+	}
+
+	got := tickerLayout{}.format(quotes, 200)
+	want := "[ticker] MSFT 410.50 +2.25 (+0.55%) | T 17.00 -0.10 (-0.58%) | " +
+		"BTC-USD 0.5000 +0.00 (+0.00%)"
+	if len(got) != 1 || got[0] != want {
+		t.Fatalf("unexpected compact output %q", got)
+	}
+	// Quotes move to another line rather than being split
+	got = tickerLayout{}.format(quotes, 60)
+	if len(got) != 2 || !strings.HasSuffix(got[0], "(-0.58%)") || len(got[0]) > 60 {
+		t.Fatalf("unexpected packing %q", got)
+	}
+
+	got = tickerLayout{style: "table", color: true}.format(quotes, 200)
+	want = strings.Join([]string{
+		"[ticker] MSFT    410.50 \x0303+2.25 (+0.55%)\x03",
+		"[ticker] T        17.00 \x0304-0.10 (-0.58%)\x03",
+		"[ticker] BTC-USD 0.5000 +0.00 (+0.00%)",
+	}, "\n")
+	if strings.Join(got, "\n") != want {
+		t.Fatalf("unexpected table output %q", got)
+	}
+
+	// Long symbols are shortened so rows fit within max and stay aligned
+	long := append([]quote{{symbol: "AVERYLONGSYMBOL.EXAMPLE", price: 1}}, quotes...)
+	got = tickerLayout{style: "table", color: true}.format(long, 44)
+	want = strings.Join([]string{
+		"[ticker] AVERYLON~   1.00 +0.00 (+0.00%)",
+		"[ticker] MSFT      410.50 \x0303+2.25 (+0.55%)\x03",
+		"[ticker] T          17.00 \x0304-0.10 (-0.58%)\x03",
+		"[ticker] BTC-USD   0.5000 +0.00 (+0.00%)",
+	}, "\n")
+	if strings.Join(got, "\n") != want {
+		t.Fatalf("unexpected table output %q", got)
+	}
+	for _, x := range got {
+		if len(x) > 44 {
+			t.Fatalf("row %q longer than the limit", x)
+		}
+	}
+
+	// Long tables are cut short rather than running into the flood limit
+	quotes = nil
+	for i := 0; i < 20; i++ {
+		quotes = append(quotes, quote{symbol: fmt.Sprintf("S%v", i), price: 1})
+	}
+	got = tickerLayout{style: "table"}.format(quotes, 200)
+	if len(got) != tickerTableMax || got[len(got)-2] != "[ticker] S13 1.00 +0.00 (+0.00%)" ||
+		got[len(got)-1] != "[ticker] +6 more" {
+		t.Fatalf("unexpected table output %q", got)
+	}
+}
+
+func TestTickerLookup(t *testing.T) {
+	m := newModuleTest(t)
+	write := func(price float64) {
+		m.quotes(`{"AAPL": {"Price": %v},
+			"MSFT": {"Price": 300, "Change": 3, "Percent": 1}}`, price)
+	}
+	write(150)
+
+	tk := &ticker{providers: m.providers, workers: 2, cacheTTL: time.Minute}
+	lookup := func(line string) []string {
+		var ret []string
+		for _, x := range m.command(tk, sourceDescriptor{nick: "alice"}, "#test", line) {
+			ret = append(ret, x.target+" "+x.text)
+		}
+		return ret
+	}
+
+	got := lookup("&q aapl msft, FOO aapl")
+	want := []string{
+		"#test [ticker] AAPL 150.00 +0.00 (+0.00%) | MSFT 300.00 +3.00 (+1.00%)",
+		"#test [ticker] unknown symbol FOO",
+	}
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Fatalf("unexpected reply %q", got)
+	}
+
+	// Quotes are reused until the TTL expires
+	write(160)
+	got = lookup("&ticker AAPL")
+	if len(got) != 1 || !strings.Contains(got[0], "AAPL 150.00") {
+		t.Fatalf("unexpected reply %q", got)
+	}
+	symbolCache["AAPL"] = symbolCacheEntry{currentPrice: 150,
+		fetched: clockNow().Add(-2 * time.Minute)}
+	got = lookup("&ticker AAPL")
+	if len(got) != 1 || !strings.Contains(got[0], "AAPL 160.00") {
+		t.Fatalf("unexpected reply %q", got)
+	}
+}
+
+func TestTickerExecute(t *testing.T) {
+	config = &cfg{Nick: "kraz"}
+	symbolCache = make(map[string]symbolCacheEntry)
+
+	// The provider blocks until released, execute must return without waiting for it
+	release := make(chan bool)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+		fmt.Fprintf(w, `{"chart":{"result":[{"meta":{"symbol":%q,"regularMarketPrice":10,
+			"chartPreviousClose":8}}]}}`, strings.TrimPrefix(r.URL.Path, "/"))
+	}))
+	defer srv.Close()
+	providers, err := newQuoteProviders([]quoteProviderCfg{{Type: "yahoo", URL: srv.URL + "/"}},
+		httpCfg{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	oc := &outputCapture{}
+	r := newCaptureRuntime(oc)
+	tk := &ticker{symbols: []string{"MSFT", "AAPL"}, channel: "#stocks", providers: providers,
+		workers: 2}
+	if err := tk.execute(r); err != nil {
+		t.Fatal(err)
+	}
+	if len(oc.calls) != 0 || r.fetching != 1 {
+		t.Fatalf("unexpected state after execute, output %v, %v fetching", oc.calls,
+			r.fetching)
+	}
+	close(release)
+	runFetches(t, r)
+	want := "[ticker] MSFT 10.00 +2.00 (+25.00%) | AAPL 10.00 +2.00 (+25.00%)"
+	if len(oc.calls) != 1 || oc.calls[0].target != "#stocks" || oc.calls[0].text != want {
+		t.Fatalf("unexpected output %v", oc.calls)
+	}
+	if _, ok := symbolCache["AAPL"]; !ok {
+		t.Fatal("fetched quote wasn't cached")
+	}
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"regexp"
+	"strings"
+)
+
+const secretFilePrefix = "file:"
+
+var secretEnvRe = regexp.MustCompile(`\$\{([A-Za-z_][A-Za-z0-9_]*)\}`)
+
+// expandSecret resolves references in a configuration value. A value of the form
+// file:/path is replaced with the contents of the file with any trailing newline
+// removed, and ${NAME} anywhere in a value is replaced with the environment variable.
+func expandSecret(val string) (string, error) {
+	if strings.HasPrefix(val, secretFilePrefix) {
+		p := strings.TrimPrefix(val, secretFilePrefix)
+		buf, err := ioutil.ReadFile(p)
+		if err != nil {
+			return "", err
+		}
+		return strings.TrimRight(string(buf), "\r\n"), nil
+	}
+
+	var err error
+	ret := secretEnvRe.ReplaceAllStringFunc(val, func(m string) string {
+		name := secretEnvRe.FindStringSubmatch(m)[1]
+		v, ok := os.LookupEnv(name)
+		if !ok && err == nil {
+			err = fmt.Errorf("environment variable %v is not set", name)
+		}
+		return v
+	})
+	if err != nil {
+		return "", err
+	}
+	return ret, nil
+}
+
+// expandSecrets walks every string in the configuration and resolves references
+// using expandSecret, errors are reported with the path of the field
+func expandSecrets(c *cfg) error {
+	return expandValue(reflect.ValueOf(c).Elem(), "")
+}
+
+func expandValue(v reflect.Value, field string) error {
+	switch v.Kind() {
+	case reflect.String:
+		ret, err := expandSecret(v.String())
+		if err != nil {
+			return fmt.Errorf("%v: %v", field, err)
+		}
+		v.SetString(ret)
+	case reflect.Struct:
+		t := v.Type()
+		for i := 0; i < v.NumField(); i++ {
+			name := strings.ToLower(t.Field(i).Name)
+			if field != "" {
+				name = field + "." + name
+			}
+			err := expandValue(v.Field(i), name)
+			if err != nil {
+				return err
+			}
+		}
+	case reflect.Map:
+		if v.Type().Elem().Kind() != reflect.String {
+			return nil
+		}
+		for _, k := range v.MapKeys() {
+			ret, err := expandSecret(v.MapIndex(k).String())
+			if err != nil {
+				return fmt.Errorf("%v.%v: %v", field, k, err)
+			}
+			v.SetMapIndex(k, reflect.ValueOf(ret))
+		}
+	case reflect.Slice:
+		for i := 0; i < v.Len(); i++ {
+			err := expandValue(v.Index(i), fmt.Sprintf("%v[%v]", field, i))
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path"
+)
+
+// stateEnabled returns true if a state directory has been configured, if not modules
+// should skip persisting anything
+func stateEnabled() bool {
+	return config.StateDir != ""
+}
+
+func statePath(name string) string {
+	return path.Join(config.StateDir, name+".json")
+}
+
+// stateSave writes v as JSON to the state file for name. The data is written to a
+// temporary file first and renamed so a crash during the write does not leave a
+// truncated state file behind.
+func stateSave(name string, v interface{}) error {
+	if !stateEnabled() {
+		return nil
+	}
+
+	buf, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	p := statePath(name)
+	tmp := p + ".tmp"
+	err = ioutil.WriteFile(tmp, buf, 0600)
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp, p)
+}
+
+// stateLoad reads the state file for name into v. A missing state file is not an
+// error, v is left untouched in that case.
+func stateLoad(name string, v interface{}) error {
+	if !stateEnabled() {
+		return nil
+	}
+
+	buf, err := ioutil.ReadFile(statePath(name))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+
+	return json.Unmarshal(buf, v)
+}
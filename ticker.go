@@ -2,10 +2,6 @@ package main
 
 import (
 	"fmt"
-	"io/ioutil"
-	"net/http"
-	"regexp"
-	"sort"
 	"strconv"
 	"strings"
 	"time"
@@ -13,17 +9,26 @@ import (
 	"github.com/dustin/go-humanize"
 )
 
-const urlPrefix = "https://ca.finance.yahoo.com/quote/"
+var tickerlog = newLogger("module:ticker")
 
 type symbolCacheEntry struct {
 	currentPrice float64
-	delta        string // Used for display only, just store the string value
-	privmsg      string // Preconstructed PRIVMSG command output
+	change       float64
+	percent      float64
+	fetched      time.Time // Zero for entries restored from state
 }
 
 var symbolCache map[string]symbolCacheEntry
 
-var unitReplacer = strings.NewReplacer(",", "", "k", "000", "K", "000", "m", "000000", "M", "000000")
+// symbolCacheState is the persisted form of a symbolCacheEntry
+type symbolCacheState struct {
+	CurrentPrice float64
+	Change       float64
+	Percent      float64
+}
+
+var unitReplacer = strings.NewReplacer(",", "", "k", "000", "K", "000", "m", "000000",
+	"M", "000000", "b", "000000000", "B", "000000000")
 
 type ticker struct {
 	symbols        []string
@@ -31,86 +36,151 @@ type ticker struct {
 	interval       time.Duration
 	executeOnJoin  bool
 	forceShouldRun bool
+	providers      []quoteProvider
+	workers        int
+	cacheTTL       time.Duration  // How long quotes looked up by commands are reused
+	calendar       *calendar      // Trading calendars, nil to use the UTC schedule hours
+	extended       bool           // Post during pre and post market sessions
+	forced         bool           // The current run was forced, post every symbol
+	reports        *tickerReports // Open and close reports, nil if not enabled
+	layout         tickerLayout
+	layouts        map[string]tickerLayout // Per channel layouts, by lower case name
 
 	lastRun time.Time
 }
 
 func (t *ticker) initialize() {
-	logger.Print("ticker initializing")
-	symbolCache = make(map[string]symbolCacheEntry)
-	t.lastRun = time.Now()
-}
-
-func fetchData(symbol string, t *ticker) error {
-	url := urlPrefix + symbol
-	logger.Printf("ticker requesting %v", url)
+	tickerlog.Print("ticker initializing")
+	// The cache is left in place if the module is being reinstantiated by a
+	// configuration reload
+	if symbolCache == nil {
+		symbolCache = make(map[string]symbolCacheEntry)
+	}
+	t.lastRun = clockNow()
+	reportsLoad()
 
-	client := &http.Client{}
-	req, err := http.NewRequest("GET", url, nil)
+	var saved map[string]symbolCacheState
+	err := stateLoad(t.getName(), &saved)
 	if err != nil {
-		return err
+		tickerlog.Errorf("ticker error loading state: %v", err)
+		return
 	}
-	if config.Http.UserAgent != "" {
-		req.Header.Set("User-Agent", config.Http.UserAgent)
+	for k, v := range saved {
+		symbolCache[strings.ToUpper(k)] = symbolCacheEntry{
+			currentPrice: v.CurrentPrice,
+			change:       v.Change,
+			percent:      v.Percent,
+		}
 	}
-
-	r, err := client.Do(req)
-	if err != nil {
-		return err
+	if len(saved) > 0 {
+		tickerlog.Printf("ticker restored %v cached symbols", len(saved))
 	}
-	defer r.Body.Close()
+}
 
-	if r.StatusCode != 200 {
-		return fmt.Errorf("request returned status code %v", r.StatusCode)
+func (t *ticker) shutdown() error {
+	saved := make(map[string]symbolCacheState)
+	for k, v := range symbolCache {
+		saved[k] = symbolCacheState{
+			CurrentPrice: v.currentPrice,
+			Change:       v.change,
+			Percent:      v.percent,
+		}
 	}
+	return stateSave(t.getName(), saved)
+}
 
-	body, err := ioutil.ReadAll(r.Body)
-	if err != nil {
-		return err
+// symbolCacheStore records a freshly fetched quote in the cache
+func symbolCacheStore(q quote) {
+	symbolCache[q.symbol] = symbolCacheEntry{
+		currentPrice: q.price,
+		change:       q.change,
+		percent:      q.percent,
+		fetched:      clockNow(),
 	}
+}
 
-	buf := string(body)
-
-	re := regexp.MustCompile("data-reactid=\"\\d+\">([0-9.]+)</span><span class")
-	m := re.FindStringSubmatch(buf)
-	if m == nil || len(m) < 2 {
-		return fmt.Errorf("current value extraction failed for %v", symbol)
+// quoteRequest looks up quotes for symbols, which should be upper case, without
+// blocking the IRC handler. Quotes fetched within ttl come from symbolCache, anything
+// else is fetched in the background and added to the cache. done is run by the IRC
+// handler with the quotes found, straight away if everything was cached, symbols with
+// no quote are missing. A ttl of zero fetches every symbol.
+func quoteRequest(r *kruntime, providers []quoteProvider, workers int, ttl time.Duration,
+	symbols []string, done func(map[string]quote)) {
+	ret := make(map[string]quote)
+	var fetch []string
+	for _, x := range symbols {
+		if v, ok := symbolCache[x]; ok && clockNow().Sub(v.fetched) < ttl {
+			ret[x] = quote{symbol: x, price: v.currentPrice, change: v.change,
+				percent: v.percent}
+			continue
+		}
+		fetch = append(fetch, x)
 	}
-
-	re = regexp.MustCompile("data-reactid=\"\\d+\">([+-]?[0-9.]+ \\([+-]?[0-9.%]+\\))</span><div id")
-	n := re.FindStringSubmatch(buf)
-	if n == nil || len(n) < 2 {
-		return fmt.Errorf("value change extraction failed for %v", symbol)
+	if len(fetch) == 0 {
+		done(ret)
+		return
 	}
+	r.background(func() func() {
+		results := quoteFetchAll(providers, fetch, workers)
+		return func() {
+			for _, x := range results {
+				if x.err != nil {
+					tickerlog.Warnf("ticker error in fetch data: %v", x.err)
+					continue
+				}
+				symbolCacheStore(x.quote)
+				ret[x.symbol] = x.quote
+			}
+			done(ret)
+		}
+	})
+}
 
-	curPrice, err := strconv.ParseFloat(m[1], 64)
-	if err != nil {
-		return fmt.Errorf("ticker error in calc float conversion, %v", err)
+// layoutFor returns the layout used for output to channel
+func (t *ticker) layoutFor(channel string) tickerLayout {
+	if l, ok := t.layouts[strings.ToLower(channel)]; ok {
+		return l
 	}
+	return t.layout
+}
 
-	newEnt := &symbolCacheEntry{
-		currentPrice: curPrice,
-		delta:        n[1],
-		privmsg:      fmt.Sprintf("PRIVMSG %v :[ticker] %v %v %v", t.channel, symbol, m[1], n[1]),
+// send writes quotes to target using the layout configured for it
+func (t *ticker) send(r *kruntime, target string, quotes []quote) {
+	max := outputTextMax("PRIVMSG", target)
+	for _, x := range t.layoutFor(target).format(quotes, max) {
+		r.out.privmsg(target, x)
 	}
-	symbolCache[symbol] = *newEnt
-
-	return nil
 }
 
 func (t *ticker) execute(r *kruntime) error {
-	t.lastRun = time.Now()
-	logger.Print("ticker module executing")
-
-	for _, x := range t.symbols {
-		err := fetchData(x, t)
-		if err != nil {
-			logger.Printf("ticker error in fetch data: %v", err)
-			continue
+	t.lastRun = clockNow()
+	tickerlog.Debugf("ticker module executing")
+
+	if t.reports != nil && !t.forced {
+		// A report includes every symbol, so it takes the place of a regular post
+		if kind := t.reports.due(t.lastRun); kind != "" {
+			t.report(r, kind, t.lastRun)
+			return nil
 		}
-		r.ircout <- []byte(symbolCache[x].privmsg)
 	}
 
+	symbols := t.symbols
+	if t.calendar != nil && !t.forced {
+		symbols = t.openSymbols(clockNow())
+	}
+	t.forced = false
+
+	quoteRequest(r, t.providers, t.workers, 0, symbols, func(found map[string]quote) {
+		var quotes []quote
+		for _, x := range symbols {
+			if q, ok := found[x]; ok {
+				quotes = append(quotes, q)
+			}
+		}
+		if len(quotes) > 0 {
+			t.send(r, t.channel, quotes)
+		}
+	})
 	return nil
 }
 
@@ -119,13 +189,27 @@ func (t *ticker) getName() string {
 }
 
 func (t *ticker) shouldRun() bool {
-	tm := time.Now()
+	tm := clockNow()
 
 	if t.forceShouldRun {
 		t.forceShouldRun = false
+		t.forced = true
+		return true
+	}
+
+	if t.reports != nil && t.reports.due(tm) != "" {
 		return true
 	}
 
+	// An interval of zero disables regular posts, leaving only the reports
+	if t.interval == 0 {
+		return false
+	}
+
+	if t.calendar != nil {
+		return len(t.openSymbols(tm)) > 0 && tm.After(t.lastRun.Add(t.interval))
+	}
+
 	if tm.Weekday() == 0 || tm.Weekday() == 6 {
 		return false
 	}
@@ -138,6 +222,17 @@ func (t *ticker) shouldRun() bool {
 	return tm.After(t.lastRun.Add(t.interval))
 }
 
+// openSymbols returns the symbols whose exchange is open at tm
+func (t *ticker) openSymbols(tm time.Time) []string {
+	var ret []string
+	for _, x := range t.symbols {
+		if t.calendar.isOpen(x, tm, t.extended) {
+			ret = append(ret, x)
+		}
+	}
+	return ret
+}
+
 func (t *ticker) shouldRunOnJoin(channel string) bool {
 	ret := t.executeOnJoin && t.channel == channel
 
@@ -146,57 +241,135 @@ func (t *ticker) shouldRunOnJoin(channel string) bool {
 		// interval so shouldRun will return success
 		t.lastRun = t.lastRun.Add(-2 * t.interval)
 		t.forceShouldRun = true
-		logger.Printf("ticker lastRun wound back to %v", t.lastRun)
+		tickerlog.Debugf("ticker lastRun wound back to %v", t.lastRun)
 	}
 
 	return ret
 }
 
 func (t *ticker) handlesCommand(cmd string) bool {
-	return cmd == "&calc" || cmd == "&ticker"
+	return cmd == "&calc" || cmd == "&ticker" || cmd == "&q"
 }
 
 func (t *ticker) handleCommand(src sourceDescriptor, cmd string, args []string, r *kruntime) {
 	switch cmd {
-	case "&ticker":
-		if len(args) < 5 {
-			var cachedSymbols []string
-			for symbol := range symbolCache {
-				cachedSymbols = append(cachedSymbols, symbol)
+	case "&ticker", "&q":
+		t.quote(src, cmd, args, r)
+	case "&calc":
+		t.calc(src, args, r)
+	}
+}
+
+// Most symbols looked up by a single &ticker or &calc command
+const tickerLookupMax = 10
+
+// quote handles &ticker <symbol> [symbol ...], fetching any symbols that aren't
+// cached
+func (t *ticker) quote(src sourceDescriptor, cmd string, args []string, r *kruntime) {
+	if len(args) < 5 {
+		r.out.reply(src, args, fmt.Sprintf("[ticker] usage: %v <symbol> [symbol ...], "+
+			"tracking: %v", cmd, strings.Join(t.symbols, " ")))
+		return
+	}
+	var symbols, invalid []string
+	for _, x := range args[4:] {
+		x = strings.ToUpper(strings.Trim(x, ","))
+		if x == "" || containsFold(symbols, x) {
+			continue
+		}
+		if strings.ContainsAny(x, "/?#&") {
+			invalid = append(invalid, x)
+			continue
+		}
+		symbols = append(symbols, x)
+	}
+	if len(symbols) > tickerLookupMax {
+		r.out.reply(src, args, fmt.Sprintf("[ticker] at most %v symbols can be looked up "+
+			"at once", tickerLookupMax))
+		return
+	}
+
+	quoteRequest(r, t.providers, t.workers, t.cacheTTL, symbols, func(found map[string]quote) {
+		var quotes []quote
+		for _, x := range symbols {
+			if q, ok := found[x]; ok {
+				quotes = append(quotes, q)
+			} else {
+				invalid = append(invalid, x)
 			}
-			sort.Strings(cachedSymbols)
-			r.ircout <- []byte(fmt.Sprintf("PRIVMSG %v :[ticker] available symbols: %v",
-				t.channel, strings.Join(cachedSymbols, " ")))
-			return
 		}
-		if v, ok := symbolCache[args[4]]; ok {
-			r.ircout <- []byte(v.privmsg)
+		if len(quotes) > 0 {
+			t.send(r, irc_reply_target(src, args), quotes)
 		}
-	case "&calc":
-		if len(args) < 6 {
-			r.ircout <- []byte(fmt.Sprintf("PRIVMSG %v :[calc] usage: &calc <symbol> <count>",
-				t.channel))
-			return
+		if len(invalid) == 1 {
+			r.out.reply(src, args, "[ticker] unknown symbol "+invalid[0])
+		} else if len(invalid) > 1 {
+			r.out.reply(src, args, "[ticker] unknown symbols "+strings.Join(invalid, ", "))
 		}
+	})
+}
 
-		symbol := strings.ToUpper(args[4])
+// calc handles &calc <expression>. The original &calc <symbol> <count> form is still
+// answered in its own format.
+func (t *ticker) calc(src sourceDescriptor, args []string, r *kruntime) {
+	if len(args) < 5 {
+		r.out.reply(src, args, "[calc] usage: &calc <expression>, for example "+
+			"&calc 150*AAPL + 20*MSFT - 5k")
+		return
+	}
 
-		if v, ok := symbolCache[symbol]; ok {
-			units, err := strconv.Atoi(unitReplacer.Replace(args[5]))
-			if err != nil {
-				logger.Printf("ticker error in unit conversion, %v", err)
-				return
-			}
+	// Repeated spaces leave empty arguments
+	if len(args) == 6 && args[4] != "" {
+		units, err := strconv.Atoi(unitReplacer.Replace(args[5]))
+		symbol := strings.ToUpper(args[4])
+		if err == nil && units > 0 && isCalcLetter(symbol[0]) {
+			quoteRequest(r, t.providers, t.workers, t.cacheTTL, []string{symbol},
+				func(found map[string]quote) {
+					q, ok := found[symbol]
+					if !ok {
+						r.out.reply(src, args, fmt.Sprintf("[calc] no quote found for %v",
+							symbol))
+						return
+					}
+					rv := float64(units) * q.price
+					r.out.reply(src, args, fmt.Sprintf("[calc] %v %v x $%v = $%v",
+						symbol, humanize.Comma(int64(units)),
+						humanize.FormatFloat("#,###.####", q.price),
+						humanize.FormatFloat("#,###.##", rv)))
+				})
+			return
+		}
+	}
 
-			if units <= 0 {
-				return
+	text := strings.TrimSpace(strings.Join(args[4:], " "))
+	expr, symbols, err := calcParse(text)
+	if err != nil {
+		r.out.reply(src, args, fmt.Sprintf("[calc] %v", err))
+		return
+	}
+	if len(symbols) > tickerLookupMax {
+		r.out.reply(src, args, fmt.Sprintf("[calc] at most %v symbols can be used "+
+			"at once", tickerLookupMax))
+		return
+	}
+	quoteRequest(r, t.providers, t.workers, t.cacheTTL, symbols, func(quotes map[string]quote) {
+		values := make(map[string]float64)
+		var prices []string
+		for _, x := range symbols {
+			if q, ok := quotes[x]; ok {
+				values[x] = q.price
+				prices = append(prices, x+" "+quoteFormatPrice(q.price))
 			}
-
-			rv := float64(units) * v.currentPrice
-			r.ircout <- []byte(fmt.Sprintf("PRIVMSG %v :[calc] %v %v x $%v = $%v",
-				t.channel, symbol, humanize.Comma(int64(units)),
-				humanize.FormatFloat("#,###.####", v.currentPrice),
-				humanize.FormatFloat("#,###.##", rv)))
 		}
-	}
+		v, err := expr.eval(values)
+		if err != nil {
+			r.out.reply(src, args, fmt.Sprintf("[calc] %v", err))
+			return
+		}
+		msg := fmt.Sprintf("[calc] %v = %v", text, calcFormat(v))
+		if len(prices) > 0 {
+			msg += fmt.Sprintf(" (%v)", strings.Join(prices, ", "))
+		}
+		r.out.reply(src, args, msg)
+	})
 }
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"unicode/utf8"
+)
+
+// mIRC color codes used for price changes
+const (
+	colorGreen = "\x0303"
+	colorRed   = "\x0304"
+	colorReset = "\x03"
+)
+
+// Rows shown by the table layout, the rest are summarized on a final line. This keeps
+// a post well inside the flood limit, which would otherwise drop the end of the table.
+const tickerTableMax = 15
+
+// tickerLayout controls how quotes are presented in a channel
+type tickerLayout struct {
+	style string // compact or table, compact if empty
+	color bool   // Show gains in green and losses in red
+}
+
+// colorChange wraps text in the color for the direction of change
+func (l tickerLayout) colorChange(change float64, text string) string {
+	if !l.color || change == 0 {
+		return text
+	}
+	if change > 0 {
+		return colorGreen + text + colorReset
+	}
+	return colorRed + text + colorReset
+}
+
+// format returns the lines shown for quotes, each no longer than max bytes
+func (l tickerLayout) format(quotes []quote, max int) []string {
+	if l.style == "table" {
+		return l.table(quotes, max)
+	}
+	return l.compact(quotes, max)
+}
+
+// compact packs quotes into as few lines as possible, a quote is never split between
+// lines
+func (l tickerLayout) compact(quotes []quote, max int) []string {
+	const prefix = "[ticker] "
+	const sep = " | "
+	var ret []string
+	line := ""
+	for _, q := range quotes {
+		item := fmt.Sprintf("%v %v %v", q.symbol, quoteFormatPrice(q.price),
+			l.colorChange(q.change, quoteFormatChange(q)))
+		if line != "" && len(line)+len(sep)+len(item) > max {
+			ret = append(ret, line)
+			line = ""
+		}
+		if line == "" {
+			line = prefix + item
+		} else {
+			line += sep + item
+		}
+	}
+	if line != "" {
+		ret = append(ret, line)
+	}
+	return ret
+}
+
+// table returns a line per quote with the columns aligned, up to tickerTableMax lines.
+// Padding is applied before color codes are added so they don't affect the alignment.
+// Symbols are shortened if a row would otherwise be longer than max, so a row is never
+// split over two lines.
+func (l tickerLayout) table(quotes []quote, max int) []string {
+	more := 0
+	if len(quotes) > tickerTableMax {
+		more = len(quotes) - tickerTableMax + 1
+		quotes = quotes[:tickerTableMax-1]
+	}
+	var sw, pw, cw int
+	rows := make([][3]string, len(quotes))
+	for i, q := range quotes {
+		rows[i] = [3]string{q.symbol, quoteFormatPrice(q.price), quoteFormatChange(q)}
+		if len(rows[i][0]) > sw {
+			sw = len(rows[i][0])
+		}
+		if len(rows[i][1]) > pw {
+			pw = len(rows[i][1])
+		}
+		if len(rows[i][2]) > cw {
+			cw = len(rows[i][2])
+		}
+	}
+	fixed := len("[ticker]   ") + pw + cw
+	if l.color {
+		fixed += len(colorGreen) + len(colorReset)
+	}
+	if sw > max-fixed {
+		sw = max - fixed
+		if sw < 2 {
+			sw = 2
+		}
+	}
+
+	var ret []string
+	for i, x := range rows {
+		if len(x[0]) > sw {
+			n := sw - 1
+			for n > 0 && !utf8.RuneStart(x[0][n]) {
+				n--
+			}
+			x[0] = x[0][:n] + "~"
+		}
+		change := fmt.Sprintf("%*v", cw, x[2])
+		line := fmt.Sprintf("[ticker] %-*v %*v %v", sw, x[0], pw, x[1],
+			l.colorChange(quotes[i].change, change))
+		ret = append(ret, strings.TrimRight(line, " "))
+	}
+	if more > 0 {
+		ret = append(ret, fmt.Sprintf("[ticker] +%v more", more))
+	}
+	return ret
+}
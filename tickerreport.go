@@ -0,0 +1,205 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// Reports are posted at most this long after the exchange opens or closes, so one
+// missed while disconnected isn't posted hours late
+var reportWindow = 30 * time.Minute
+
+// Report kinds
+const (
+	REPORT_OPEN  = "open"
+	REPORT_CLOSE = "close"
+)
+
+const defaultOpenTemplate = `[open] {{.Exchange}} is open{{if .Indices}} | ` +
+	`{{join .Indices " | "}}{{end}}`
+
+const defaultCloseTemplate = `[close] {{.Exchange}} closed {{.Date}}{{if .Indices}} | ` +
+	`{{join .Indices " | "}}{{end}}
+{{if .Quotes}}[close] {{join .Quotes " | "}}{{end}}
+{{if .Gainers}}[close] gainers: {{join .Gainers ", "}}{{end}}
+{{if .Losers}}[close] losers: {{join .Losers ", "}}{{end}}`
+
+// Local date each report was last posted on, by report kind and exchange. Kept
+// outside the module so a configuration reload doesn't post a report again, and
+// persisted so a restart doesn't either.
+var reportsPosted map[string]string
+
+// Name of the state file reportsPosted is persisted in
+const reportsStateName = "ticker-reports"
+
+// reportsLoad restores reportsPosted from state, unless a configuration reload has
+// left it in place
+func reportsLoad() {
+	if reportsPosted != nil {
+		return
+	}
+	reportsPosted = make(map[string]string)
+	err := stateLoad(reportsStateName, &reportsPosted)
+	if err != nil {
+		tickerlog.Errorf("ticker error loading report state: %v", err)
+	}
+}
+
+// tickerReport is the data available to report templates. Quotes are formatted as
+// symbol, price and change.
+type tickerReport struct {
+	Exchange string
+	Date     string
+	Quotes   []string // Tracked symbols
+	Indices  []string
+	Gainers  []string // Largest percentage gains, largest first
+	Losers   []string // Largest percentage losses, largest first
+}
+
+// tickerReports configures the reports posted when an exchange opens and closes
+type tickerReports struct {
+	exchange *exchange
+	open     *template.Template // nil if no open report is posted
+	close    *template.Template // nil if no close report is posted
+	indices  []string
+	movers   int
+}
+
+// postedKey returns the key for a report of kind in reportsPosted
+func (t *tickerReports) postedKey(kind string) string {
+	return kind + " " + t.exchange.name
+}
+
+// newTickerReports parses the report templates, empty templates use the defaults
+func newTickerReports(c tickerReportsCfg, cal *calendar) (*tickerReports, error) {
+	ret := &tickerReports{movers: c.Movers, exchange: cal.def}
+	if c.Exchange != "" {
+		ret.exchange = cal.exchanges[strings.ToUpper(c.Exchange)]
+		if ret.exchange == nil {
+			return nil, fmt.Errorf("report exchange %q is not in the calendar", c.Exchange)
+		}
+	}
+	if ret.movers == 0 {
+		ret.movers = 3
+	}
+	for _, x := range c.Indices {
+		ret.indices = append(ret.indices, strings.ToUpper(x))
+	}
+
+	funcs := template.FuncMap{"join": strings.Join}
+	var err error
+	if c.Open {
+		text := c.OpenTemplate
+		if text == "" {
+			text = defaultOpenTemplate
+		}
+		ret.open, err = template.New("open").Funcs(funcs).Parse(text)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if c.Close {
+		text := c.CloseTemplate
+		if text == "" {
+			text = defaultCloseTemplate
+		}
+		ret.close, err = template.New("close").Funcs(funcs).Parse(text)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return ret, nil
+}
+
+// due returns the kind of report due at tm, or an empty string if none is
+func (t *tickerReports) due(tm time.Time) string {
+	open, close, ok := t.exchange.hours(tm)
+	if !ok {
+		return ""
+	}
+	date := tm.In(t.exchange.loc).Format("2006-01-02")
+	posted := func(kind string) bool {
+		return reportsPosted[t.postedKey(kind)] == date
+	}
+	if t.open != nil && !posted(REPORT_OPEN) && !tm.Before(open) &&
+		tm.Before(open.Add(reportWindow)) && tm.Before(close) {
+		return REPORT_OPEN
+	}
+	if t.close != nil && !posted(REPORT_CLOSE) && !tm.Before(close) &&
+		tm.Before(close.Add(reportWindow)) {
+		return REPORT_CLOSE
+	}
+	return ""
+}
+
+// report posts the report of kind to the ticker channel once its quotes have been
+// fetched. It is marked as posted straight away so it isn't started again meanwhile.
+func (t *ticker) report(r *kruntime, kind string, tm time.Time) {
+	rep := t.reports
+	date := tm.In(rep.exchange.loc).Format("2006-01-02")
+	tmpl := rep.open
+	if kind == REPORT_CLOSE {
+		tmpl = rep.close
+	}
+	reportsPosted[rep.postedKey(kind)] = date
+	if err := stateSave(reportsStateName, reportsPosted); err != nil {
+		tickerlog.Errorf("ticker error saving report state: %v", err)
+	}
+	tickerlog.Printf("ticker posting %v report for %v", kind, rep.exchange.name)
+
+	symbols := append(append([]string{}, t.symbols...), rep.indices...)
+	quoteRequest(r, t.providers, t.workers, 0, symbols, func(found map[string]quote) {
+		t.postReport(r, kind, tmpl, date, found)
+	})
+}
+
+// postReport formats and posts a report from the quotes found
+func (t *ticker) postReport(r *kruntime, kind string, tmpl *template.Template, date string,
+	found map[string]quote) {
+	rep := t.reports
+	layout := t.layoutFor(t.channel)
+	format := func(q quote) string {
+		return fmt.Sprintf("%v %v %v", q.symbol, quoteFormatPrice(q.price),
+			layout.colorChange(q.change, quoteFormatChange(q)))
+	}
+	data := tickerReport{Exchange: rep.exchange.name, Date: date}
+	var quotes []quote
+	for _, x := range t.symbols {
+		if q, ok := found[x]; ok {
+			data.Quotes = append(data.Quotes, format(q))
+			quotes = append(quotes, q)
+		}
+	}
+	for _, x := range rep.indices {
+		if q, ok := found[x]; ok {
+			data.Indices = append(data.Indices, format(q))
+		}
+	}
+
+	sort.SliceStable(quotes, func(i, j int) bool { return quotes[i].percent > quotes[j].percent })
+	for i := 0; i < len(quotes) && len(data.Gainers) < rep.movers; i++ {
+		if quotes[i].percent > 0 {
+			data.Gainers = append(data.Gainers, format(quotes[i]))
+		}
+	}
+	for i := len(quotes) - 1; i >= 0 && len(data.Losers) < rep.movers; i-- {
+		if quotes[i].percent < 0 {
+			data.Losers = append(data.Losers, format(quotes[i]))
+		}
+	}
+
+	var b strings.Builder
+	err := tmpl.Execute(&b, data)
+	if err != nil {
+		tickerlog.Errorf("ticker error in %v report template: %v", kind, err)
+		return
+	}
+	for _, x := range strings.Split(b.String(), "\n") {
+		if strings.TrimSpace(x) != "" {
+			r.out.privmsg(t.channel, x)
+		}
+	}
+}
@@ -1,7 +1,6 @@
 package main
 
 import (
-	"fmt"
 	"io/ioutil"
 	"math/rand"
 	"path"
@@ -9,6 +8,12 @@ import (
 	"time"
 )
 
+var writerlog = newLogger("module:writer")
+
+// writerRand picks and scrambles entries, replay seeds it from the capture so the
+// output is the same each time
+var writerRand = rand.New(rand.NewSource(time.Now().UnixNano()))
+
 type writer struct {
 	channel  string
 	datapath string
@@ -22,7 +27,7 @@ func (w *writer) getName() string {
 }
 
 func (w *writer) shouldRun() bool {
-	return w.interval.Seconds() != 0 && time.Now().After(w.lastRun.Add(w.interval))
+	return w.interval.Seconds() != 0 && clockNow().After(w.lastRun.Add(w.interval))
 }
 
 func (w *writer) shouldRunOnJoin(channel string) bool {
@@ -38,14 +43,14 @@ func (w *writer) handleCommand(src sourceDescriptor, cmd string, args []string,
 
 	list, err := w.availableEntries()
 	if err != nil {
-		logger.Printf("writer error getting available entries, %v", err)
+		writerlog.Errorf("writer error getting available entries, %v", err)
 		return
 	}
 
 	if len(args) >= 5 {
 		if args[4] == "list" {
 			buf := strings.Join(list, " ")
-			r.ircout <- []byte(fmt.Sprintf("PRIVMSG %v :writer: available: %v", target, buf))
+			r.out.privmsg(target, "writer: available: "+buf)
 		} else {
 			found := false
 			for _, x := range list {
@@ -54,13 +59,13 @@ func (w *writer) handleCommand(src sourceDescriptor, cmd string, args []string,
 				}
 			}
 			if !found {
-				logger.Printf("writer source %v not available", args[4])
+				writerlog.Warnf("writer source %v not available", args[4])
 				return
 			}
 			w.write(target, args[4], r)
 		}
 	} else {
-		upath := list[rand.Intn(len(list))]
+		upath := list[writerRand.Intn(len(list))]
 		w.write(target, upath, r)
 	}
 }
@@ -86,21 +91,20 @@ func (w *writer) write(target string, source string, r *kruntime) error {
 	}
 
 	parts := strings.Split(string(buf), "\n")
-	rand.Seed(time.Now().UnixNano())
-	rand.Shuffle(len(parts), func(i, j int) { parts[i], parts[j] = parts[j], parts[i] })
+	writerRand.Shuffle(len(parts), func(i, j int) { parts[i], parts[j] = parts[j], parts[i] })
 
 	for _, x := range parts {
 		val := string(x)
 		if val == "" {
 			continue
 		}
-		p := rand.Intn(5)
+		p := writerRand.Intn(5)
 		if p == 0 && len(val) <= 6 {
 			for _, y := range val {
-				r.ircout <- []byte(fmt.Sprintf("PRIVMSG %v :%v", target, string(y)))
+				r.out.privmsg(target, string(y))
 			}
 		} else {
-			b := rand.Intn(6) == 0
+			b := writerRand.Intn(6) == 0
 			msg := string(val[0])
 			for _, y := range val[1:] {
 				msg += " " + string(y)
@@ -108,7 +112,7 @@ func (w *writer) write(target string, source string, r *kruntime) error {
 			if b {
 				msg = "" + msg + ""
 			}
-			r.ircout <- []byte(fmt.Sprintf("PRIVMSG %v :%v", target, msg))
+			r.out.privmsg(target, msg)
 		}
 	}
 
@@ -116,13 +120,12 @@ func (w *writer) write(target string, source string, r *kruntime) error {
 }
 
 func (w *writer) execute(r *kruntime) error {
-	w.lastRun = time.Now()
-	logger.Print("writer module executing")
+	w.lastRun = clockNow()
+	writerlog.Debugf("writer module executing")
 
-	rand.Seed(time.Now().UnixNano())
-	val := rand.Intn(10)
+	val := writerRand.Intn(10)
 	if val > 0 {
-		logger.Printf("writer skipping, %v != 0", val)
+		writerlog.Debugf("writer skipping, %v != 0", val)
 		return nil
 	}
 
@@ -131,13 +134,17 @@ func (w *writer) execute(r *kruntime) error {
 		return err
 	}
 
-	upath := list[rand.Intn(len(list))]
+	upath := list[writerRand.Intn(len(list))]
 	w.write(w.channel, upath, r)
 
 	return nil
 }
 
 func (w *writer) initialize() {
-	logger.Print("writer initializing")
-	w.lastRun = time.Now()
+	writerlog.Print("writer initializing")
+	w.lastRun = clockNow()
+}
+
+func (w *writer) shutdown() error {
+	return nil
 }